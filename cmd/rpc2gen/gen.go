@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"strings"
+	"unicode"
+)
+
+const rpc2Import = "github.com/maxtaco/go-framed-msgpack-rpc/rpc2"
+
+var primitives = map[string]string{
+	"boolean": "bool",
+	"int":     "int",
+	"long":    "int64",
+	"float":   "float32",
+	"double":  "float64",
+	"string":  "string",
+	"bytes":   "[]byte",
+}
+
+// method is a message, ready to be written out.
+type method struct {
+	Message
+	goName  string
+	argType string // the record that holds the request
+	newArg  bool   // whether argType is made up from the parameters
+	resType string // empty if there's no result
+}
+
+type generator struct {
+	s       *Schema
+	named   map[string]bool
+	methods []method
+	buf     bytes.Buffer
+}
+
+// Generate writes the Go code for s, in package pkg: its types, a server
+// interface, a function that makes an rpc2.Protocol from it, and a typed
+// client. The source is named in the header.
+func Generate(s *Schema, pkg string, source string) (ret []byte, err error) {
+	g := &generator{s: s, named: make(map[string]bool)}
+	for _, t := range s.Types {
+		g.named[t.Name] = true
+	}
+	if err = g.resolve(); err != nil {
+		return
+	}
+
+	g.p("// Code generated by rpc2gen from %s. DO NOT EDIT.\n\n", source)
+	g.p("package %s\n\n", pkg)
+	g.p("import (\n\t%q\n)\n", rpc2Import)
+	for _, t := range s.Types {
+		if err = g.namedType(t); err != nil {
+			return
+		}
+	}
+	for _, m := range g.methods {
+		if m.newArg {
+			if err = g.record(NamedType{Name: m.argType, Fields: m.Request}); err != nil {
+				return
+			}
+		}
+	}
+	g.serverInterface()
+	g.protocol()
+	g.client()
+
+	if ret, err = format.Source(g.buf.Bytes()); err != nil {
+		err = fmt.Errorf("formatting generated code: %v", err)
+	}
+	return
+}
+
+func (g *generator) p(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) doc(indent string, doc string) {
+	for _, line := range strings.Split(strings.TrimSpace(doc), "\n") {
+		if len(line) > 0 {
+			g.p("%s// %s\n", indent, strings.TrimSpace(line))
+		}
+	}
+}
+
+// resolve works out the argument and result types of every message. A
+// message with a single record parameter takes that record; otherwise,
+// its parameters are gathered into a new record, named after it.
+func (g *generator) resolve() (err error) {
+	for _, m := range g.s.Messages {
+		meth := method{Message: m, goName: exported(m.Name)}
+		if len(m.Request) == 1 && g.named[typeName(m.Request[0].Type)] {
+			meth.argType = exported(typeName(m.Request[0].Type))
+		} else {
+			meth.argType, meth.newArg = meth.goName+"Arg", true
+			if g.named[meth.argType] {
+				return fmt.Errorf("message %s: type %s is already declared", m.Name, meth.argType)
+			}
+		}
+		if len(m.Response) > 0 {
+			if meth.resType, err = g.goType(m.Response); err != nil {
+				return fmt.Errorf("message %s: %v", m.Name, err)
+			}
+		}
+		if m.OneWay && len(meth.resType) > 0 {
+			return fmt.Errorf("message %s: one-way messages can't have a response", m.Name)
+		}
+		g.methods = append(g.methods, meth)
+	}
+	return
+}
+
+// typeName returns the name in a type that's just a name, like "AddArgs".
+func typeName(raw json.RawMessage) (ret string) {
+	json.Unmarshal(raw, &ret)
+	return
+}
+
+// goType returns the Go type for an Avro type, or "" for null.
+func (g *generator) goType(raw json.RawMessage) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	return g.goTypeOf(v)
+}
+
+func (g *generator) goTypeOf(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		if t == "null" {
+			return "", nil
+		}
+		if p, found := primitives[t]; found {
+			return p, nil
+		}
+		if g.named[t] {
+			return exported(t), nil
+		}
+		return "", fmt.Errorf("unknown type %q", t)
+	case []interface{}:
+		// Only unions with null are supported, as pointers.
+		if len(t) == 2 && (t[0] == "null") != (t[1] == "null") {
+			other := t[0]
+			if other == "null" {
+				other = t[1]
+			}
+			s, err := g.goTypeOf(other)
+			if err != nil {
+				return "", err
+			}
+			return "*" + s, nil
+		}
+		return "", fmt.Errorf("unsupported union %v; only [\"null\", T] is", t)
+	case map[string]interface{}:
+		switch t["type"] {
+		case "array":
+			s, err := g.goTypeOf(t["items"])
+			if err != nil {
+				return "", err
+			}
+			return "[]" + s, nil
+		case "map":
+			s, err := g.goTypeOf(t["values"])
+			if err != nil {
+				return "", err
+			}
+			return "map[string]" + s, nil
+		}
+		return "", fmt.Errorf("unsupported type %v; declare named types in \"types\"", t["type"])
+	}
+	return "", fmt.Errorf("bad type %v", v)
+}
+
+func (g *generator) namedType(t NamedType) error {
+	switch t.Type {
+	case "record":
+		return g.record(t)
+	case "enum":
+		g.p("\n")
+		g.doc("", t.Doc)
+		name := exported(t.Name)
+		g.p("type %s int\n\nconst (\n", name)
+		for i, sym := range t.Symbols {
+			g.p("\t%s%s %s = %d\n", name, camel(sym), name, i)
+		}
+		g.p(")\n")
+	case "fixed":
+		g.p("\n")
+		g.doc("", t.Doc)
+		g.p("type %s [%d]byte\n", exported(t.Name), t.Size)
+	default:
+		return fmt.Errorf("type %s: unsupported kind %q", t.Name, t.Type)
+	}
+	return nil
+}
+
+func (g *generator) record(t NamedType) error {
+	g.p("\n")
+	g.doc("", t.Doc)
+	g.p("type %s struct {\n", exported(t.Name))
+	for _, f := range t.Fields {
+		ft, err := g.goType(f.Type)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", t.Name, f.Name, err)
+		}
+		if len(ft) == 0 {
+			return fmt.Errorf("%s.%s: fields can't be null", t.Name, f.Name)
+		}
+		g.doc("\t", f.Doc)
+		tag := fmt.Sprintf(`codec:"%s" json:"%s"`, f.Name, f.Name)
+		if f.Sensitive {
+			tag += ` rpc:"sensitive"`
+		}
+		g.p("\t%s %s `%s`\n", exported(f.Name), ft, tag)
+	}
+	g.p("}\n")
+	return nil
+}
+
+func (g *generator) results(m method) string {
+	if len(m.resType) == 0 {
+		return "error"
+	}
+	return fmt.Sprintf("(%s, error)", m.resType)
+}
+
+func (g *generator) serverInterface() {
+	name := exported(g.s.Protocol)
+	g.p("\n")
+	g.doc("", g.s.Doc)
+	g.p("type %sInterface interface {\n", name)
+	for _, m := range g.methods {
+		g.doc("\t", m.Doc)
+		g.p("\t%s(*%s) %s\n", m.goName, m.argType, g.results(m))
+	}
+	g.p("}\n")
+}
+
+func (g *generator) protocol() {
+	name := exported(g.s.Protocol)
+	g.p("\nfunc %sProtocol(i %sInterface) rpc2.Protocol {\n", name, name)
+	g.p("\treturn rpc2.Protocol{\n\t\tName: %q,\n", g.s.FullName())
+	g.p("\t\tMethods: map[string]rpc2.ServeHook{\n")
+	for _, m := range g.methods {
+		g.p("\t\t\t%q: func(nxt rpc2.DecodeNext) (ret interface{}, err error) {\n", m.Name)
+		g.p("\t\t\t\tvar args %s\n", m.argType)
+		g.p("\t\t\t\tif err = nxt(&args); err == nil {\n")
+		if len(m.resType) == 0 {
+			g.p("\t\t\t\t\terr = i.%s(&args)\n", m.goName)
+		} else {
+			g.p("\t\t\t\t\tret, err = i.%s(&args)\n", m.goName)
+		}
+		g.p("\t\t\t\t}\n\t\t\t\treturn\n\t\t\t},\n")
+	}
+	g.p("\t\t},\n")
+	var sensitive []string
+	for _, m := range g.methods {
+		if m.Sensitive {
+			sensitive = append(sensitive, fmt.Sprintf("%q: true", m.Name))
+		}
+	}
+	if len(sensitive) > 0 {
+		g.p("\t\tSensitive: map[string]bool{%s},\n", strings.Join(sensitive, ", "))
+	}
+	g.p("\t}\n}\n")
+}
+
+func (g *generator) client() {
+	name := exported(g.s.Protocol) + "Client"
+	g.p("\ntype %s struct {\n\trpc2.GenericClient\n}\n", name)
+	for _, m := range g.methods {
+		full := g.s.FullName() + "." + m.Name
+		g.p("\n")
+		g.doc("", m.Doc)
+		switch {
+		case m.OneWay:
+			g.p("func (c %s) %s(arg %s) error {\n", name, m.goName, m.argType)
+			g.p("\treturn c.Notify(%q, arg)\n}\n", full)
+		case len(m.resType) == 0:
+			g.p("func (c %s) %s(arg %s) error {\n", name, m.goName, m.argType)
+			g.p("\treturn c.Call(%q, arg, nil)\n}\n", full)
+		default:
+			g.p("func (c %s) %s(arg %s) (ret %s, err error) {\n", name, m.goName, m.argType, m.resType)
+			g.p("\terr = c.Call(%q, arg, &ret)\n\treturn\n}\n", full)
+		}
+	}
+}
+
+// exported upper-cases the first letter of s.
+func exported(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	r := []rune(s)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// camel turns an enum symbol like "NOT_FOUND" into "NotFound".
+func camel(s string) string {
+	var b strings.Builder
+	for _, w := range strings.Split(s, "_") {
+		b.WriteString(exported(strings.ToLower(w)))
+	}
+	return b.String()
+}
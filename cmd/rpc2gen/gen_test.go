@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func generate(t *testing.T, desc string) string {
+	s, err := ParseSchema([]byte(desc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Generate(s, "keys", "keys.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// The example's generated code should be what we'd generate now.
+func TestExampleUpToDate(t *testing.T) {
+	desc, err := os.ReadFile("../../rpc2/example/arith.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("../../rpc2/example/arith_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ParseSchema(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Generate(s, "main", "arith.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("arith_gen.go is stale; run go generate in rpc2/example. We'd generate:\n%s", got)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	out := generate(t, `{
+		"protocol": "keys",
+		"namespace": "test.1",
+		"types": [
+			{"type": "enum", "name": "KeyType", "symbols": ["NONE", "PGP_KEY"]},
+			{"type": "fixed", "name": "KID", "size": 35},
+			{"type": "record", "name": "Key", "doc": "Key is a key.", "fields": [
+				{"name": "kid", "type": "KID"},
+				{"name": "type", "type": "KeyType"},
+				{"name": "armored", "type": "string", "sensitive": true},
+				{"name": "parent", "type": ["null", "Key"]},
+				{"name": "uids", "type": {"type": "array", "items": "string"}},
+				{"name": "sigs", "type": {"type": "map", "values": "bytes"}}
+			]}
+		],
+		"messages": {
+			"export": {"request": [{"name": "kid", "type": "KID"}, {"name": "secret", "type": "boolean"}],
+				"response": "Key", "sensitive": true},
+			"forget": {"request": [{"name": "key", "type": "Key"}], "response": "null"},
+			"ping": {"request": [], "one-way": true}
+		}
+	}`)
+
+	for _, want := range []string{
+		"KeyTypeNone   KeyType = 0\n\tKeyTypePgpKey KeyType = 1",
+		"type KID [35]byte",
+		"// Key is a key.\ntype Key struct",
+		"`codec:\"armored\" json:\"armored\" rpc:\"sensitive\"`",
+		"Parent  *Key",
+		"Uids    []string",
+		"Sigs    map[string][]byte",
+		"type ExportArg struct {\n\tKid    KID  `codec:\"kid\" json:\"kid\"`\n\tSecret bool `codec:\"secret\" json:\"secret\"`\n}",
+		"type PingArg struct {\n}",
+		"Export(*ExportArg) (Key, error)\n\tForget(*Key) error\n\tPing(*PingArg) error",
+		"err = i.Forget(&args)",
+		"Sensitive: map[string]bool{\"export\": true}",
+		"func (c KeysClient) Export(arg ExportArg) (ret Key, err error) {\n\terr = c.Call(\"test.1.keys.export\", arg, &ret)",
+		"return c.Call(\"test.1.keys.forget\", arg, nil)",
+		"return c.Notify(\"test.1.keys.ping\", arg)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Missing %q from:\n%s", want, out)
+		}
+	}
+	// Messages keep the order they were described in.
+	if strings.Index(out, "\"export\":") > strings.Index(out, "\"ping\":") {
+		t.Errorf("Messages out of order:\n%s", out)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for desc, want := range map[string]string{
+		`{"protocol": "p", "messages": {"m": {"request": [], "response": "Nope"}}}`:                                            `message m: unknown type "Nope"`,
+		`{"protocol": "p", "messages": {"m": {"request": [], "response": ["int", "string"]}}}`:                                 `unsupported union`,
+		`{"protocol": "p", "messages": {"m": {"request": [], "response": "int", "one-way": true}}}`:                            `can't have a response`,
+		`{"protocol": "p", "types": [{"type": "error", "name": "E"}]}`:                                                         `unsupported kind "error"`,
+		`{"protocol": "p", "types": [{"type": "record", "name": "R", "fields": [{"name": "f", "type": {"type": "record"}}]}]}`: `R.f: unsupported type record`,
+		`{"namespace": "p"}`: `no protocol name`,
+	} {
+		s, err := ParseSchema([]byte(desc))
+		if err == nil {
+			_, err = Generate(s, "p", "p.json")
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Wanted an error with %q for %s; got %v", want, desc, err)
+		}
+	}
+}
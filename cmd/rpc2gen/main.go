@@ -0,0 +1,58 @@
+// Command rpc2gen makes Go code for an rpc2 protocol, from its description
+// in the JSON form of AVDL: the protocol's types, an interface for its
+// server, a function to make an rpc2.Protocol from one, and a typed client.
+//
+// Run it from go generate, like:
+//
+//	//go:generate go run github.com/maxtaco/go-framed-msgpack-rpc/cmd/rpc2gen -i arith.json -o arith_gen.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	in := flag.String("i", "", "the protocol description (stdin by default)")
+	out := flag.String("o", "", "the Go file to write (stdout by default)")
+	pkg := flag.String("package", os.Getenv("GOPACKAGE"), "the package of the generated code")
+	flag.Parse()
+
+	if err := run(*in, *out, *pkg); err != nil {
+		fmt.Fprintf(os.Stderr, "rpc2gen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(in string, out string, pkg string) (err error) {
+	if len(pkg) == 0 {
+		pkg = "main"
+	}
+	source := "stdin"
+	var b []byte
+	if len(in) == 0 {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		source = filepath.Base(in)
+		b, err = os.ReadFile(in)
+	}
+	if err != nil {
+		return
+	}
+
+	var s *Schema
+	if s, err = ParseSchema(b); err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	if b, err = Generate(s, pkg, source); err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	if len(out) == 0 {
+		_, err = os.Stdout.Write(b)
+		return
+	}
+	return os.WriteFile(out, b, 0644)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Schema is a protocol description, in the JSON form of AVDL (as made by
+// avdl2json, or Avro's idl tool):
+//
+//	{
+//	  "protocol": "arith",
+//	  "namespace": "test.1",
+//	  "types": [
+//	    {"type": "record", "name": "AddArgs", "fields": [
+//	      {"name": "A", "type": "int"}, {"name": "B", "type": "int"}]}
+//	  ],
+//	  "messages": {
+//	    "add": {"request": [{"name": "args", "type": "AddArgs"}], "response": "int"}
+//	  }
+//	}
+//
+// Fields and messages can be marked "sensitive", to keep them out of logs.
+type Schema struct {
+	Protocol  string      `json:"protocol"`
+	Namespace string      `json:"namespace"`
+	Doc       string      `json:"doc"`
+	Types     []NamedType `json:"types"`
+	Messages  Messages    `json:"messages"`
+}
+
+// NamedType is a record, an enum or a fixed.
+type NamedType struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Doc     string   `json:"doc"`
+	Fields  []Field  `json:"fields"`
+	Symbols []string `json:"symbols"`
+	Size    int      `json:"size"`
+}
+
+// Field is a field of a record, or a parameter of a message.
+type Field struct {
+	Name      string          `json:"name"`
+	Type      json.RawMessage `json:"type"`
+	Doc       string          `json:"doc"`
+	Sensitive bool            `json:"sensitive"`
+}
+
+type Message struct {
+	Name      string          `json:"-"`
+	Doc       string          `json:"doc"`
+	Request   []Field         `json:"request"`
+	Response  json.RawMessage `json:"response"`
+	OneWay    bool            `json:"one-way"`
+	Sensitive bool            `json:"sensitive"`
+}
+
+// Messages keeps the order messages were described in, so that the code
+// made from them is in the same order.
+type Messages []Message
+
+func (m *Messages) UnmarshalJSON(b []byte) (err error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var t json.Token
+	if t, err = dec.Token(); err != nil {
+		return
+	}
+	if t != json.Delim('{') {
+		return errors.New("messages should be an object")
+	}
+	for dec.More() {
+		if t, err = dec.Token(); err != nil {
+			return
+		}
+		msg := Message{Name: t.(string)}
+		if err = dec.Decode(&msg); err != nil {
+			return fmt.Errorf("message %s: %v", msg.Name, err)
+		}
+		*m = append(*m, msg)
+	}
+	return
+}
+
+// ParseSchema reads a protocol description.
+func ParseSchema(b []byte) (s *Schema, err error) {
+	s = new(Schema)
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if len(s.Protocol) == 0 {
+		return nil, errors.New("no protocol name")
+	}
+	return
+}
+
+// FullName is the protocol's name on the wire, like "test.1.arith".
+func (s *Schema) FullName() string {
+	if len(s.Namespace) == 0 {
+		return s.Protocol
+	}
+	return s.Namespace + "." + s.Protocol
+}
@@ -1,18 +1,139 @@
 package rpc2
 
+import (
+	"context"
+	"time"
+)
+
+// ClientOptions control how a Client makes its calls.
+type ClientOptions struct {
+	// Timeout is how long to wait for the reply to a call before giving
+	// up on it with a TimeoutError. Zero means wait forever.
+	Timeout time.Duration
+
+	// MethodTimeouts overrides Timeout for individual methods, keyed by
+	// full method name (like "test.1.arith.add"). A zero entry means
+	// that method never times out.
+	MethodTimeouts map[string]time.Duration
+
+	// SendDeadlines sends the time left before the context's deadline
+	// with each call, as metadata, so that the server can give up when
+	// we do. Only turn it on if the server understands metadata.
+	SendDeadlines bool
+}
+
+// GenericClient is what typed client stubs, like those made by
+// cmd/rpc2gen, make their calls with. A *Client is one.
+type GenericClient interface {
+	Call(method string, arg interface{}, res interface{}) error
+	Notify(method string, arg interface{}) error
+}
+
 type Client struct {
-	xp          Transporter
-	unwrapError UnwrapErrorFunc
+	xp           Transporter
+	unwrapError  UnwrapErrorFunc
+	opts         ClientOptions
+	interceptors []ClientInterceptor
 }
 
 func NewClient(xp Transporter, f UnwrapErrorFunc) *Client {
-	return &Client{xp, f}
+	return NewClientWithOptions(xp, f, ClientOptions{})
+}
+
+func NewClientWithOptions(xp Transporter, f UnwrapErrorFunc, opts ClientOptions) *Client {
+	return &Client{xp: xp, unwrapError: f, opts: opts}
+}
+
+// Use adds an interceptor around every call and notify made from now on.
+// Interceptors run in the order they were added, the first outermost. Add
+// them all before making any calls; Use isn't safe to call concurrently
+// with them.
+func (c *Client) Use(i ClientInterceptor) {
+	c.interceptors = append(c.interceptors, i)
+}
+
+func (c *Client) timeoutFor(method string) time.Duration {
+	if t, found := c.opts.MethodTimeouts[method]; found {
+		return t
+	}
+	return c.opts.Timeout
 }
 
 func (c *Client) Call(method string, arg interface{}, res interface{}) (err error) {
-	var d Dispatcher
-	if d, err = c.xp.GetDispatcher(); err == nil {
-		err = d.Call(method, arg, res, c.unwrapError)
+	return c.CallContext(context.Background(), method, arg, res)
+}
+
+// CallContext is like Call, but gives up as soon as ctx is cancelled or
+// its deadline passes, returning ctx.Err(). A reply that shows up after
+// that is quietly discarded. Metadata attached to ctx with WithMetadata
+// is sent with the call.
+func (c *Client) CallContext(ctx context.Context, method string, arg interface{}, res interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	info := &CallInfo{Method: method, Metadata: outgoingMetadata(ctx)}
+	invoke := func(ctx context.Context, arg interface{}, res interface{}) error {
+		md := info.Metadata
+		if c.opts.SendDeadlines {
+			md = addTimeout(ctx, md)
+		}
+		call := c.send(ctx, method, arg, res, md)
+		info.Seqid = call.seqid
+		err := call.wait(ctx)
+		info.ReplyMetadata = call.replyMeta
+		return err
+	}
+	return chainClient(c.interceptors, info, invoke)(ctx, arg, res)
+}
+
+// Notify sends a one-way message to the server. The server runs the
+// matching ServeHook but never replies, so there's no result to decode.
+func (c *Client) Notify(method string, arg interface{}) (err error) {
+	info := &CallInfo{Method: method, Notify: true}
+	invoke := func(ctx context.Context, arg interface{}, res interface{}) (err error) {
+		var d Dispatcher
+		if d, err = c.xp.GetDispatcher(); err == nil {
+			err = d.Notify(method, arg)
+		}
+		return
+	}
+	return chainClient(c.interceptors, info, invoke)(context.Background(), arg, nil)
+}
+
+// Go starts a call and returns without waiting for the reply. Wait on
+// the returned Call's Done channel, or call its Err method, to find out
+// how it went; res is only safe to read after that.
+func (c *Client) Go(method string, arg interface{}, res interface{}) *Call {
+	if len(c.interceptors) == 0 {
+		return c.send(context.Background(), method, arg, res, nil)
+	}
+
+	// The interceptors might make any number of calls, so the Call we
+	// hand back stands for the whole chain; cancelling it cancels the
+	// chain's context.
+	ctx, stop := context.WithCancel(context.Background())
+	call := &Call{method: method, arg: arg, res: res, stop: stop}
+	call.Init()
+	go func() {
+		call.finish(c.CallContext(ctx, method, arg, res))
+		stop()
+	}()
+	return call
+}
+
+// send sends a call straight to the dispatcher, bypassing interceptors.
+// If the dispatcher traces calls, the call is part of ctx's trace.
+func (c *Client) send(ctx context.Context, method string, arg interface{}, res interface{}, md Metadata) *Call {
+	d, err := c.xp.GetDispatcher()
+	if err != nil {
+		return newFailedCall(method, err)
+	}
+	var call *Call
+	if dp := asDispatch(d); dp != nil {
+		call = dp.goContext(ctx, method, arg, res, md, c.unwrapError)
+	} else {
+		call = d.Go(method, arg, res, md, c.unwrapError)
 	}
-	return
+	call.setTimeout(c.timeoutFor(method))
+	return call
 }
@@ -1,5 +1,13 @@
 package rpc2
 
+import (
+	"github.com/ugorji/go/codec"
+)
+
 type Decoder interface {
 	Decode(interface{}) error
 }
+
+func newMsgpackHandle() *codec.MsgpackHandle {
+	return &codec.MsgpackHandle{WriteExt: true}
+}
@@ -4,4 +4,5 @@ const (
 	TYPE_CALL     = 0
 	TYPE_RESPONSE = 1
 	TYPE_NOTIFY   = 2
+	TYPE_CANCEL   = 3
 )
@@ -1,49 +1,104 @@
 package rpc2
 
-import "sync"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 type DecodeNext func(interface{}) error
 type ServeHook func(DecodeNext) (interface{}, error)
 
+// ContextServeHook is like ServeHook, but also gets a context that's
+// cancelled when the connection to the caller goes away, so that
+// long-running handlers can give up early.
+type ContextServeHook func(context.Context, DecodeNext) (interface{}, error)
+
 // EOFHook is typically called when a transport has to shut down.
 // We supply it with the exact error that caused the shutdown, which
 // should be io.EOF under normal circumstances.
 type EOFHook func(error)
 
+// Dispatcher is what a Packetizer and a Client need from a Dispatch. The
+// rest of a Dispatch's settings are only on *Dispatch.
 type Dispatcher interface {
 	Dispatch(m *Message) error
 	Call(name string, arg interface{}, res interface{}, f UnwrapErrorFunc) error
+	CallContext(ctx context.Context, name string, arg interface{}, res interface{}, f UnwrapErrorFunc) error
+	Go(name string, arg interface{}, res interface{}, md Metadata, f UnwrapErrorFunc) *Call
+	Notify(name string, arg interface{}) error
 	RegisterProtocol(Protocol) error
 	RegisterEOFHook(EOFHook) error
 	Reset(error) error
 }
 
+// Protocol is a named set of methods. A method can be served either from
+// Methods or from ContextMethods; if the same name is in both, the
+// ContextMethods entry wins. The arguments and results of methods marked
+// in Sensitive are never logged.
 type Protocol struct {
-	Name      string
-	Methods   map[string]ServeHook
-	WrapError WrapErrorFunc
+	Name           string
+	Methods        map[string]ServeHook
+	ContextMethods map[string]ContextServeHook
+	Sensitive      map[string]bool
+	WrapError      WrapErrorFunc
 }
 
 type Dispatch struct {
-	protocols  map[string]Protocol
-	calls      map[int]*Call
-	seqid      int
-	callsMutex *sync.Mutex
-	xp         Transporter
-	log        LogInterface
-	wrapError  WrapErrorFunc
-	eofHook    EOFHook
+	protocols      map[string]Protocol
+	protocolsMutex *sync.Mutex
+	calls          map[int]*Call
+	abandoned      *abandonedSet
+	seqid          int
+	callsMutex     *sync.Mutex
+	requests       map[int]*Request
+	requestsMutex  *sync.Mutex
+	serving        *sync.WaitGroup
+	draining       bool
+	limiter        *limiter
+	interceptors   []ServerInterceptor
+	tracer         *Tracer
+	metrics        Metrics
+	logPolicy      LogPolicy
+	sensitive      map[string]bool
+	sendCancels    bool
+	xp             Transporter
+	log            LogInterface
+	wrapError      WrapErrorFunc
+	eofHook        EOFHook
+	ctx            context.Context
+	cancel         context.CancelFunc
+
+	// replay, if set, says whether calls to the given method should be
+	// kept and sent again, rather than failed, when they can't be sent
+	// or the connection drops. Only a ReconnectingTransport sets it.
+	replay replayer
+}
+
+type replayer interface {
+	shouldReplay(method string) bool
+	// replayPending asks for calls marked pending to be sent again as
+	// soon as there's a connection to send them on.
+	replayPending()
 }
 
 func NewDispatch(xp Transporter, l LogInterface, wef WrapErrorFunc) *Dispatch {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Dispatch{
-		protocols:  make(map[string]Protocol),
-		calls:      make(map[int]*Call),
-		seqid:      0,
-		callsMutex: new(sync.Mutex),
-		xp:         xp,
-		log:        l,
-		wrapError:  wef,
+		protocols:      make(map[string]Protocol),
+		protocolsMutex: new(sync.Mutex),
+		calls:          make(map[int]*Call),
+		abandoned:      newAbandonedSet(maxAbandoned),
+		seqid:          0,
+		callsMutex:     new(sync.Mutex),
+		requests:       make(map[int]*Request),
+		requestsMutex:  new(sync.Mutex),
+		serving:        new(sync.WaitGroup),
+		xp:             xp,
+		log:            l,
+		wrapError:      wef,
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 }
 
@@ -54,21 +109,133 @@ type Request struct {
 	method    string
 	err       interface{}
 	res       interface{}
-	hook      ServeHook
+	hook      ContextServeHook
 	wrapError WrapErrorFunc
+	notify    bool
+	cancel    context.CancelFunc
+	limiter   *limiter
+	queued    bool
+	meta      Metadata
+	replyMeta Metadata
 }
 
+// Call is an outstanding call to the remote side. It's completed exactly
+// once: by the reply, by Reset, or by being abandoned by the caller.
+// Whoever removes it from Dispatch.calls gets to complete it.
 type Call struct {
-	ch          chan error
+	done        chan struct{}
+	err         error
 	method      string
 	seqid       int
+	arg         interface{}
 	res         interface{}
 	unwrapError UnwrapErrorFunc
 	profiler    Profiler
+	dispatch    *Dispatch
+	timer       *time.Timer
+	pending     bool
+	meta        Metadata
+	replyMeta   Metadata
+	span        *activeSpan
+	metrics     Metrics
+	started     time.Time
+
+	// stop, if set, cancels the context of a call that's being made
+	// through a Client's interceptors; see Client.Go.
+	stop context.CancelFunc
 }
 
 func (c *Call) Init() {
-	c.ch = make(chan error)
+	c.done = make(chan struct{})
+}
+
+func (c *Call) finish(err error) {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.span.finish(err)
+	if c.metrics != nil {
+		c.metrics.CallFinished(SideClient, c.method, Outcome(err), time.Since(c.started))
+	}
+	c.err = err
+	close(c.done)
+}
+
+// Done returns a channel that's closed once the call completes, whether
+// with a reply, an error, or by being cancelled.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err waits for the call to complete, and then returns its error. Once
+// it returns, the result has been decoded into the res passed to Go.
+func (c *Call) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Cancel gives up on the call, which then completes with
+// context.Canceled. If the reply has already arrived, Cancel does
+// nothing, and the call completes normally.
+func (c *Call) Cancel() {
+	c.abandon(context.Canceled)
+}
+
+func (c *Call) abandon(e error) {
+	if c.stop != nil {
+		c.stop()
+	} else if c.dispatch != nil {
+		c.dispatch.abandonCall(c, e)
+	}
+}
+
+// wait blocks until the call completes or ctx is done, whichever comes
+// first, and returns the call's error.
+func (c *Call) wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.abandon(ctx.Err())
+	}
+	return c.Err()
+}
+
+// setTimeout arranges for the call to fail with a TimeoutError if it
+// hasn't completed after d. It does nothing for calls that have already
+// completed.
+func (c *Call) setTimeout(d time.Duration) {
+	if d <= 0 || c.dispatch == nil {
+		return
+	}
+	c.dispatch.callsMutex.Lock()
+	defer c.dispatch.callsMutex.Unlock()
+	if _, found := c.dispatch.calls[c.seqid]; !found {
+		return
+	}
+	c.timer = time.AfterFunc(d, func() {
+		c.abandon(TimeoutError{Method: c.method, Seqid: c.seqid})
+	})
+}
+
+// ReplyMetadata returns the metadata that came with the reply, if any.
+// It's only safe to call once the call has completed.
+func (c *Call) ReplyMetadata() Metadata {
+	return c.replyMeta
+}
+
+func (c *Call) message() []interface{} {
+	v := []interface{}{TYPE_CALL, c.seqid, c.method, c.arg}
+	if len(c.meta) > 0 {
+		v = append(v, c.meta)
+	}
+	return v
+}
+
+func newFailedCall(method string, err error) *Call {
+	c := &Call{method: method}
+	c.Init()
+	c.finish(err)
+	return c
 }
 
 func (r *Request) reply() error {
@@ -78,29 +245,101 @@ func (r *Request) reply() error {
 		r.err,
 		r.res,
 	}
+	if len(r.replyMeta) > 0 {
+		v = append(v, r.replyMeta)
+	}
 	return r.msg.Encode(v)
 }
 
 func (r *Request) serve() {
 	prof := r.dispatch.log.StartProfiler("serve %s", r.method)
+	var span *activeSpan
+	if !r.notify {
+		span = r.dispatch.getTracer().startSpan(SpanKindServer, r.method, r.seqno, r.meta[MetadataTraceparent])
+	}
+	metrics := r.dispatch.getMetrics()
+	started := time.Now()
+	if metrics != nil && !r.notify {
+		metrics.CallStarted(SideServer, r.method)
+	}
 	nxt := r.msg.makeDecodeNext(func(v interface{}) {
-		r.dispatch.log.ServerCall(r.seqno, r.method, nil, v)
+		if r.notify {
+			notifyLog(r.dispatch.log).ServerNotifyCall(r.method, nil, r.dispatch.logged(r.method, v))
+		} else {
+			r.dispatch.log.ServerCall(r.seqno, r.method, nil, r.dispatch.logged(r.method, v))
+		}
 	})
 
+	connCtx := r.dispatch.connContext()
+	ctx, cancel := handlerContext(connCtx, r.meta, r.replyMeta)
+	if span != nil {
+		ctx = ContextWithSpan(ctx, span.context())
+	} else if sc, ok := parseTraceparent(r.meta[MetadataTraceparent]); ok {
+		// We're not tracing, but calls the handler makes on traced
+		// connections can still be part of the caller's trace.
+		ctx = ContextWithSpan(ctx, sc)
+	}
+	r.cancel = cancel
+	if !r.notify {
+		r.dispatch.registerRequest(r)
+	}
+
 	go func() {
-		res, err := r.hook(nxt)
+		defer r.dispatch.serving.Done()
+		res, err := r.run(ctx, nxt)
+		if !r.notify {
+			r.dispatch.unregisterRequest(r)
+		}
+		cancel()
 		if prof != nil {
 			prof.Stop()
 		}
+		span.finish(err)
+		if metrics != nil && !r.notify {
+			metrics.CallFinished(SideServer, r.method, Outcome(err), time.Since(started))
+		}
+		if r.notify {
+			// Notifies never get a reply, so there's nowhere to send
+			// the result or the error other than the log.
+			notifyLog(r.dispatch.log).ServerNotifyComplete(r.method, err)
+			return
+		}
 		r.err = r.msg.WrapError(r.wrapError, err)
 		r.res = res
-		r.dispatch.log.ServerReply(r.seqno, r.method, err, r.res)
+		r.dispatch.log.ServerReply(r.seqno, r.method, err, r.dispatch.logged(r.method, r.res))
+		if connCtx.Err() != nil {
+			// The connection is gone, so there's no one to reply to.
+			return
+		}
 		if err = r.reply(); err != nil {
 			r.dispatch.log.Warning("Reply error for %d: %s", r.seqno, err.Error())
 		}
 	}()
 }
 
+// run runs the request's hook, wrapped in the server's interceptors, once
+// the limiter lets it.
+func (r *Request) run(ctx context.Context, nxt DecodeNext) (interface{}, error) {
+	info := &CallInfo{
+		Method:        r.method,
+		Seqid:         r.seqno,
+		Notify:        r.notify,
+		Metadata:      r.meta,
+		ReplyMetadata: r.replyMeta,
+	}
+	hook := chainServer(r.dispatch.getInterceptors(), info, r.hook)
+	if r.limiter == nil {
+		return hook(ctx, nxt)
+	}
+	if r.queued {
+		if err := r.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	defer r.limiter.release()
+	return hook(ctx, nxt)
+}
+
 func (d *Dispatch) nextSeqid() int {
 	ret := d.seqid
 	d.seqid++
@@ -111,41 +350,379 @@ func (d *Dispatch) registerCall(c *Call) {
 	d.calls[c.seqid] = c
 }
 
+// connContext returns the context for the current connection, which is
+// cancelled when the connection goes away.
+func (d *Dispatch) connContext() context.Context {
+	d.requestsMutex.Lock()
+	defer d.requestsMutex.Unlock()
+	return d.ctx
+}
+
+// startServing counts a new request as running, unless we're draining,
+// in which case it returns false and the request shouldn't be served.
+func (d *Dispatch) startServing() bool {
+	d.requestsMutex.Lock()
+	defer d.requestsMutex.Unlock()
+	if d.draining {
+		return false
+	}
+	d.serving.Add(1)
+	return true
+}
+
+// admit decides whether a request can be served: not if we're draining,
+// nor if we're running as many handlers as we're allowed and the queue is
+// full. If it can, it's counted as running until it's done.
+func (d *Dispatch) admit(r *Request) error {
+	if !d.startServing() {
+		return ShuttingDownError{}
+	}
+	d.requestsMutex.Lock()
+	l := d.limiter
+	d.requestsMutex.Unlock()
+	if l == nil {
+		return nil
+	}
+	depth, err := l.admit()
+	if err != nil {
+		d.serving.Done()
+		limitLog(d.log).ServerBusy(r.seqno, r.method)
+		return err
+	}
+	if depth > 0 {
+		r.queued = true
+		limitLog(d.log).ServerQueued(r.seqno, r.method, depth)
+	}
+	r.limiter = l
+	return nil
+}
+
+// SetServerOptions limits the handlers we run at once, from now on.
+func (d *Dispatch) SetServerOptions(opts ServerOptions) {
+	d.requestsMutex.Lock()
+	d.limiter = newLimiter(opts)
+	d.requestsMutex.Unlock()
+}
+
+// Use adds an interceptor around every request served from now on.
+// Interceptors run in the order they were added, the first outermost.
+func (d *Dispatch) Use(i ServerInterceptor) {
+	d.requestsMutex.Lock()
+	// Copy, so that requests already running keep the chain they had.
+	ics := make([]ServerInterceptor, len(d.interceptors), len(d.interceptors)+1)
+	copy(ics, d.interceptors)
+	d.interceptors = append(ics, i)
+	d.requestsMutex.Unlock()
+}
+
+func (d *Dispatch) getInterceptors() []ServerInterceptor {
+	d.requestsMutex.Lock()
+	defer d.requestsMutex.Unlock()
+	return d.interceptors
+}
+
+// SetTracer makes spans for calls made and served from now on, and
+// passes trace context along in metadata. Only use it if the remote side
+// understands metadata.
+func (d *Dispatch) SetTracer(t *Tracer) {
+	d.requestsMutex.Lock()
+	d.tracer = t
+	d.requestsMutex.Unlock()
+}
+
+func (d *Dispatch) getTracer() *Tracer {
+	d.requestsMutex.Lock()
+	defer d.requestsMutex.Unlock()
+	return d.tracer
+}
+
+// SetMetrics reports calls made and served from now on to m.
+func (d *Dispatch) SetMetrics(m Metrics) {
+	d.requestsMutex.Lock()
+	d.metrics = m
+	d.requestsMutex.Unlock()
+}
+
+func (d *Dispatch) getMetrics() Metrics {
+	d.requestsMutex.Lock()
+	defer d.requestsMutex.Unlock()
+	return d.metrics
+}
+
+// SetLogPolicy controls how arguments and results are logged from now on.
+func (d *Dispatch) SetLogPolicy(p LogPolicy) {
+	sensitive := make(map[string]bool)
+	for _, m := range p.SensitiveMethods {
+		sensitive[m] = true
+	}
+	d.requestsMutex.Lock()
+	d.logPolicy = p
+	d.sensitive = sensitive
+	d.requestsMutex.Unlock()
+}
+
+// logged wraps an argument or result of method for the log, according to
+// the log policy, and the Sensitive methods of the protocol serving it.
+func (d *Dispatch) logged(method string, v interface{}) LoggedValue {
+	d.requestsMutex.Lock()
+	sensitive, max := d.sensitive[method], d.logPolicy.maxBytes()
+	d.requestsMutex.Unlock()
+	if !sensitive {
+		p, m := SplitMethodName(method)
+		prot, _ := d.getProtocol(p)
+		sensitive = prot.Sensitive[m]
+	}
+	return LoggedValue{v: v, sensitive: sensitive, maxBytes: max}
+}
+
+// Drain stops serving new calls and notifies; from now on, calls get a
+// ShuttingDownError back. It returns a channel that's closed once every
+// request that's already running has finished and sent its reply.
+func (d *Dispatch) Drain() <-chan struct{} {
+	d.requestsMutex.Lock()
+	d.draining = true
+	d.requestsMutex.Unlock()
+
+	ch := make(chan struct{})
+	go func() {
+		d.serving.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+func (d *Dispatch) registerRequest(r *Request) {
+	d.requestsMutex.Lock()
+	d.requests[r.seqno] = r
+	d.requestsMutex.Unlock()
+}
+
+func (d *Dispatch) unregisterRequest(r *Request) {
+	d.requestsMutex.Lock()
+	// After a reconnect, a new request might have reused our seqno.
+	if d.requests[r.seqno] == r {
+		delete(d.requests, r.seqno)
+	}
+	d.requestsMutex.Unlock()
+}
+
 func (d *Dispatch) Call(name string, arg interface{}, res interface{}, f UnwrapErrorFunc) (err error) {
+	return d.CallContext(context.Background(), name, arg, res, f)
+}
+
+// CallContext is like Call, but gives up as soon as ctx is cancelled or
+// its deadline passes.
+func (d *Dispatch) CallContext(ctx context.Context, name string, arg interface{}, res interface{}, f UnwrapErrorFunc) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	return d.goContext(ctx, name, arg, res, outgoingMetadata(ctx), f).wait(ctx)
+}
+
+// Go sends a call to the remote side, and returns without waiting for the
+// reply. Errors, including errors sending the call, are reported through
+// the returned Call.
+func (d *Dispatch) Go(name string, arg interface{}, res interface{}, md Metadata, f UnwrapErrorFunc) *Call {
+	return d.goContext(context.Background(), name, arg, res, md, f)
+}
+
+// goContext is like Go, but if we're tracing, and md doesn't say which
+// trace the call is part of, the call's span is a child of ctx's. The
+// trace context is only sent if we're tracing, since the remote side
+// might not understand metadata.
+func (d *Dispatch) goContext(ctx context.Context, name string, arg interface{}, res interface{}, md Metadata, f UnwrapErrorFunc) *Call {
 
 	d.callsMutex.Lock()
 
 	seqid := d.nextSeqid()
-	v := []interface{}{TYPE_CALL, seqid, name, arg}
 	profiler := d.log.StartProfiler("call %s", name)
+	parent := md[MetadataTraceparent]
+	if sc, ok := SpanFromContext(ctx); ok && len(parent) == 0 {
+		parent = sc.traceparent()
+	}
+	span := d.getTracer().startSpan(SpanKindClient, name, seqid, parent)
+	if span != nil {
+		md = span.inject(md)
+	}
 	call := &Call{
 		method:      name,
 		seqid:       seqid,
+		arg:         arg,
 		res:         res,
+		meta:        md,
 		unwrapError: f,
 		profiler:    profiler,
+		span:        span,
+		metrics:     d.getMetrics(),
+		started:     time.Now(),
+		dispatch:    d,
 	}
 	call.Init()
+	if call.metrics != nil {
+		call.metrics.CallStarted(SideClient, name)
+	}
 	d.registerCall(call)
+	v := call.message()
 
 	d.callsMutex.Unlock()
 
-	err = d.xp.Encode(v)
-	if err != nil {
+	if err := d.xp.Encode(v); err != nil {
+		if d.sendFailed(call, err) && d.replay != nil {
+			d.replay.replayPending()
+		}
+		return call
+	}
+	d.log.ClientCall(seqid, name, d.logged(name, arg))
+	return call
+}
+
+// sendFailed deals with a call that couldn't be sent. Either it's failed
+// with err, or, if it should be replayed, it's marked as pending so that
+// it'll be sent again on the next connection; in that case we return
+// true.
+func (d *Dispatch) sendFailed(c *Call, err error) (pending bool) {
+	d.callsMutex.Lock()
+	_, found := d.calls[c.seqid]
+	if found && d.replay != nil && d.replay.shouldReplay(c.method) {
+		c.pending = true
+		pending = true
+	} else {
+		delete(d.calls, c.seqid)
+	}
+	d.callsMutex.Unlock()
+	if found && !pending {
+		c.finish(err)
+	}
+	return
+}
+
+// resendPending sends again every call that's marked as pending. Calls
+// that fail to send are marked pending again, for next time.
+func (d *Dispatch) resendPending() {
+	d.callsMutex.Lock()
+	var todo []*Call
+	for _, c := range d.calls {
+		if c.pending {
+			c.pending = false
+			todo = append(todo, c)
+		}
+	}
+	d.callsMutex.Unlock()
+
+	for _, c := range todo {
+		if err := d.xp.Encode(c.message()); err != nil {
+			d.sendFailed(c, err)
+		} else {
+			d.log.ClientCall(c.seqid, c.method, d.logged(c.method, c.arg))
+		}
+	}
+}
+
+// maxAbandoned is how many abandoned calls we remember, to quietly drop
+// their late replies.
+const maxAbandoned = 1024
+
+// abandonedSet holds the seqids of recently abandoned calls. Past its
+// size, it forgets the oldest, so that replies that never come don't pile
+// up on a long-lived connection.
+type abandonedSet struct {
+	ids  map[int]bool
+	ring []int
+	next int
+}
+
+func newAbandonedSet(n int) *abandonedSet {
+	return &abandonedSet{ids: make(map[int]bool), ring: make([]int, 0, n)}
+}
+
+func (a *abandonedSet) add(seqid int) {
+	if len(a.ring) < cap(a.ring) {
+		a.ring = append(a.ring, seqid)
+	} else {
+		delete(a.ids, a.ring[a.next])
+		a.ring[a.next] = seqid
+		a.next = (a.next + 1) % len(a.ring)
+	}
+	a.ids[seqid] = true
+}
+
+// take says whether seqid was abandoned, and forgets it.
+func (a *abandonedSet) take(seqid int) bool {
+	if !a.ids[seqid] {
+		return false
+	}
+	delete(a.ids, seqid)
+	return true
+}
+
+// abandonCall gives up on a call that the caller no longer wants,
+// completing it with e. If the reply has already been claimed by
+// dispatchResponse (or the call was failed by Reset), it's too late to
+// back out, since the reply might be halfway decoded into c.res; in
+// that case the call completes normally.
+func (d *Dispatch) abandonCall(c *Call, e error) {
+	d.callsMutex.Lock()
+	_, found := d.calls[c.seqid]
+	if found {
+		delete(d.calls, c.seqid)
+		d.abandoned.add(c.seqid)
+	}
+	sendCancel := d.sendCancels
+	d.callsMutex.Unlock()
+
+	if !found {
 		return
 	}
-	d.log.ClientCall(seqid, name, arg)
-	err = <-call.ch
+	if c.profiler != nil {
+		c.profiler.Stop()
+	}
+	c.finish(e)
+	if sendCancel {
+		d.sendCancel(c)
+	}
+}
+
+// sendCancel tells the remote side that we've given up on c, so that it
+// can stop working on it. It's best-effort: the reply might already be
+// on its way, and that's fine, since it'll be thrown away.
+func (d *Dispatch) sendCancel(c *Call) {
+	v := []interface{}{TYPE_CANCEL, c.seqid, c.method}
+	if err := d.xp.Encode(v); err != nil {
+		d.log.Warning("Cancel error for %d: %s", c.seqid, err.Error())
+		return
+	}
+	cancelLog(d.log).ClientCancel(c.seqid, c.method)
+}
+
+// SetSendCancels controls whether abandoned calls are announced to the
+// remote side with a TYPE_CANCEL message. It's off by default, since
+// older peers don't know about TYPE_CANCEL and will hang up on us if
+// they get one; only turn it on if the peer is known to handle it.
+func (d *Dispatch) SetSendCancels(b bool) {
+	d.callsMutex.Lock()
+	d.sendCancels = b
+	d.callsMutex.Unlock()
+}
+
+// Notify sends a fire-and-forget message to the remote side. There's no
+// seqid and no reply, so we return as soon as the message is written.
+func (d *Dispatch) Notify(name string, arg interface{}) (err error) {
+	v := []interface{}{TYPE_NOTIFY, name, arg}
+	if err = d.xp.Encode(v); err != nil {
+		return
+	}
+	notifyLog(d.log).ClientNotify(name, d.logged(name, arg))
 	return
 }
 
-func (d *Dispatch) findServeHook(n string) (srv ServeHook, wrapError WrapErrorFunc, err error) {
+func (d *Dispatch) findServeHook(n string) (srv ContextServeHook, wrapError WrapErrorFunc, err error) {
 	p, m := SplitMethodName(n)
 	var prot Protocol
 	var found bool
-	if prot, found = d.protocols[p]; !found {
+	if prot, found = d.getProtocol(p); !found {
 		err = ProtocolNotFoundError{p}
-	} else if srv, found = prot.Methods[m]; !found {
+	} else if srv, found = prot.findServeHook(m); !found {
 		err = MethodNotFoundError{p, m}
 	}
 	if found {
@@ -157,6 +734,21 @@ func (d *Dispatch) findServeHook(n string) (srv ServeHook, wrapError WrapErrorFu
 	return
 }
 
+// findServeHook looks up method m, adapting a plain ServeHook to a
+// ContextServeHook that ignores its context if need be.
+func (p Protocol) findServeHook(m string) (ContextServeHook, bool) {
+	if h, found := p.ContextMethods[m]; found {
+		return h, true
+	}
+	h, found := p.Methods[m]
+	if !found {
+		return nil, false
+	}
+	return func(_ context.Context, nxt DecodeNext) (interface{}, error) {
+		return h(nxt)
+	}, true
+}
+
 func (d *Dispatch) dispatchCall(m *Message) (err error) {
 	req := Request{msg: m, dispatch: d}
 
@@ -166,15 +758,33 @@ func (d *Dispatch) dispatchCall(m *Message) (err error) {
 	if err = m.Decode(&req.method); err != nil {
 		return
 	}
+	if m.nFields == 5 {
+		// The caller understands metadata, so it can have some back.
+		if err = m.takeTrailer(&req.meta); err != nil {
+			return
+		}
+		if req.meta == nil {
+			req.meta = make(Metadata)
+		}
+		req.replyMeta = make(Metadata)
+	}
 
 	var se error
 	var wrapError WrapErrorFunc
-	if req.hook, wrapError, se = d.findServeHook(req.method); se != nil {
+	req.hook, wrapError, se = d.findServeHook(req.method)
+	if se == nil {
+		se = d.admit(&req)
+	}
+	if se != nil {
 		req.err = m.WrapError(wrapError, se)
 		if err = m.decodeToNull(); err != nil {
 			return
 		}
 		d.log.ServerCall(req.seqno, req.method, se, nil)
+		if metrics := d.getMetrics(); metrics != nil {
+			metrics.CallStarted(SideServer, req.method)
+			metrics.CallFinished(SideServer, req.method, Outcome(se), 0)
+		}
 		err = req.reply()
 	} else {
 		req.wrapError = wrapError
@@ -183,7 +793,66 @@ func (d *Dispatch) dispatchCall(m *Message) (err error) {
 	return
 }
 
+func (d *Dispatch) dispatchNotify(m *Message) (err error) {
+	req := Request{msg: m, dispatch: d, notify: true}
+
+	if err = m.Decode(&req.method); err != nil {
+		return
+	}
+
+	var se error
+	req.hook, req.wrapError, se = d.findServeHook(req.method)
+	if se == nil {
+		se = d.admit(&req)
+	}
+	if se != nil {
+		if err = m.decodeToNull(); err != nil {
+			return
+		}
+		notifyLog(d.log).ServerNotifyCall(req.method, se, nil)
+	} else {
+		req.serve()
+	}
+	return
+}
+
+func (d *Dispatch) dispatchCancel(m *Message) (err error) {
+	var seqno int
+	var method string
+
+	if err = m.Decode(&seqno); err != nil {
+		return
+	}
+	if err = m.Decode(&method); err != nil {
+		return
+	}
+
+	d.requestsMutex.Lock()
+	req := d.requests[seqno]
+	delete(d.requests, seqno)
+	d.requestsMutex.Unlock()
+
+	cancelLog(d.log).ServerCancelCall(seqno, method)
+
+	// The request might well have finished already, in which case
+	// there's nothing left to cancel.
+	if req != nil {
+		req.cancel()
+	}
+	return
+}
+
+// dispatchUnknown skips over a message of a type we don't understand.
+// Peers newer than us might send them, and they're better off ignored
+// than treated as fatal to the whole connection.
+func (d *Dispatch) dispatchUnknown(m *Message, l int) error {
+	d.log.Warning("Ignoring message of unknown type=%d (n=%d fields)", l, m.nFields)
+	return m.decodeToNull()
+}
+
 func (d *Dispatch) RegisterProtocol(p Protocol) (err error) {
+	d.protocolsMutex.Lock()
+	defer d.protocolsMutex.Unlock()
 	if _, found := d.protocols[p.Name]; found {
 		err = AlreadyRegisteredError{p.Name}
 	} else {
@@ -192,12 +861,21 @@ func (d *Dispatch) RegisterProtocol(p Protocol) (err error) {
 	return err
 }
 
+func (d *Dispatch) getProtocol(name string) (p Protocol, found bool) {
+	d.protocolsMutex.Lock()
+	p, found = d.protocols[name]
+	d.protocolsMutex.Unlock()
+	return
+}
+
 // RegisterEOFHook registers a function to call when the dispatcher
 // hits EOF. The hook will be called with whatever error caused the
 // channel to close.  Usually this should be io.EOF, but it can
 // of course be otherwise.
 func (d *Dispatch) RegisterEOFHook(h EOFHook) error {
+	d.protocolsMutex.Lock()
 	d.eofHook = h
+	d.protocolsMutex.Unlock()
 	return nil
 }
 
@@ -210,13 +888,20 @@ func (d *Dispatch) dispatchResponse(m *Message) (err error) {
 
 	d.callsMutex.Lock()
 	var call *Call
+	var abandoned bool
 	if call = d.calls[seqno]; call != nil {
 		delete(d.calls, seqno)
+	} else {
+		abandoned = d.abandoned.take(seqno)
 	}
 	d.callsMutex.Unlock()
 
 	if call == nil {
-		d.log.UnexpectedReply(seqno)
+		// Late replies to calls that were cancelled locally are expected,
+		// so throw them away without complaint.
+		if !abandoned {
+			d.log.UnexpectedReply(seqno)
+		}
 		err = m.decodeToNull()
 		return
 	}
@@ -234,7 +919,10 @@ func (d *Dispatch) dispatchResponse(m *Message) (err error) {
 			decode_to = &tmp
 		}
 		err = m.Decode(decode_to)
-		d.log.ClientReply(seqno, call.method, err, decode_to)
+		if err == nil && m.nFields == 5 {
+			err = m.Decode(&call.replyMeta)
+		}
+		d.log.ClientReply(seqno, call.method, err, d.logged(call.method, decode_to))
 	} else {
 		d.log.ClientReply(seqno, call.method, err, nil)
 	}
@@ -246,47 +934,71 @@ func (d *Dispatch) dispatchResponse(m *Message) (err error) {
 		}
 	}
 
-	call.ch <- apperr
+	call.finish(apperr)
 
 	return
 }
 
 func (d *Dispatch) Reset(eofError error) error {
 	d.callsMutex.Lock()
+	var failed []*Call
 	for k, v := range d.calls {
-		v.ch <- EofError{}
+		if d.replay != nil && d.replay.shouldReplay(v.method) {
+			v.pending = true
+			continue
+		}
+		failed = append(failed, v)
 		delete(d.calls, k)
 	}
+	d.abandoned = newAbandonedSet(maxAbandoned)
 	d.callsMutex.Unlock()
-	if d.eofHook != nil {
-		d.eofHook(eofError)
+
+	for _, v := range failed {
+		v.finish(EofError{})
+	}
+
+	// Let any handlers that are still running know that their caller
+	// is gone, and start afresh in case there's another connection.
+	d.requestsMutex.Lock()
+	d.cancel()
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.requests = make(map[int]*Request)
+	d.requestsMutex.Unlock()
+
+	d.protocolsMutex.Lock()
+	h := d.eofHook
+	d.protocolsMutex.Unlock()
+	if h != nil {
+		h(eofError)
 	}
 	return nil
 }
 
+// Dispatch handles an incoming message. Calls and replies are quads,
+// with an optional fifth element for metadata; notifies and cancels are
+// triples. Other messages, of the right size, are skipped, so that new
+// message types don't break old peers.
 func (d *Dispatch) Dispatch(m *Message) (err error) {
-	if m.nFields == 4 {
-		err = d.dispatchQuad(m)
-	} else {
-		err = NewDispatcherError("can only handle message quads (got n=%d fields)", m.nFields)
+	if m.nFields < 3 || m.nFields > 5 {
+		return NewDispatcherError("can only handle messages of 3 to 5 fields (got n=%d fields)", m.nFields)
 	}
-	return
-}
 
-func (d *Dispatch) dispatchQuad(m *Message) (err error) {
 	var l int
 	if err = m.Decode(&l); err != nil {
 		return
 	}
 
-	switch l {
-	case TYPE_CALL:
+	switch {
+	case l == TYPE_CALL && m.nFields >= 4:
 		d.dispatchCall(m)
-	case TYPE_RESPONSE:
+	case l == TYPE_RESPONSE && m.nFields >= 4:
 		d.dispatchResponse(m)
+	case l == TYPE_NOTIFY && m.nFields == 3:
+		err = d.dispatchNotify(m)
+	case l == TYPE_CANCEL && m.nFields == 3:
+		err = d.dispatchCancel(m)
 	default:
-		err = NewDispatcherError("Unexpected message type=%d; wanted CALL=%d or RESPONSE=%d",
-			l, TYPE_CALL, TYPE_RESPONSE)
+		err = d.dispatchUnknown(m, l)
 	}
 	return
 }
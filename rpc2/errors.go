@@ -64,3 +64,82 @@ type AlreadyRegisteredError struct {
 func (a AlreadyRegisteredError) Error() string {
 	return a.p + ": protocol already registered"
 }
+
+type TimeoutError struct {
+	Method string
+	Seqid  int
+}
+
+func (t TimeoutError) Error() string {
+	return fmt.Sprintf("call %d to '%s' timed out", t.Seqid, t.Method)
+}
+
+type ServerClosedError struct{}
+
+func (s ServerClosedError) Error() string {
+	return "server closed"
+}
+
+type ShuttingDownError struct{}
+
+func (s ShuttingDownError) Error() string {
+	return "server is shutting down"
+}
+
+// FrameSizeError means a frame from the remote side was bigger than we
+// allow, or that its message didn't fill it exactly. Either way, we can't
+// trust the framing any more, and drop the connection.
+type FrameSizeError struct {
+	Declared int // the frame's length prefix
+	Consumed int // bytes its message used; more than Declared if it overran
+	Max      int // the limit it broke, if it was too big
+}
+
+func (f FrameSizeError) Error() string {
+	switch {
+	case f.Max > 0 || f.Declared < 0:
+		return fmt.Sprintf("frame of %d bytes is outside the limit of %d", f.Declared, f.Max)
+	case f.Consumed > f.Declared:
+		return fmt.Sprintf("frame declared %d bytes, but its message ran past the end", f.Declared)
+	default:
+		return fmt.Sprintf("frame declared %d bytes, but its message used only %d", f.Declared, f.Consumed)
+	}
+}
+
+// ServerBusyError is the reply to a call that came in while the server
+// was running as many handlers as it's allowed, with a full queue.
+type ServerBusyError struct{}
+
+func (s ServerBusyError) Error() string {
+	return "server busy"
+}
+
+// ProtocolValueError means ProtocolFromValue couldn't serve a value,
+// usually because one of its methods has the wrong signature.
+type ProtocolValueError struct {
+	Type   string
+	Method string // empty if the problem isn't with one method
+	Reason string
+}
+
+func (p ProtocolValueError) Error() string {
+	if len(p.Method) == 0 {
+		return fmt.Sprintf("can't serve %s: %s", p.Type, p.Reason)
+	}
+	return fmt.Sprintf("can't serve %s: method %s %s", p.Type, p.Method, p.Reason)
+}
+
+// StubError means BindClient couldn't fill in a stub, usually because one
+// of its fields has the wrong signature.
+type StubError struct {
+	Type   string
+	Field  string // empty if the problem isn't with one field
+	Reason string
+}
+
+func (s StubError) Error() string {
+	if len(s.Field) == 0 {
+		return fmt.Sprintf("can't bind %s: %s", s.Type, s.Reason)
+	}
+	return fmt.Sprintf("can't bind %s: field %s %s", s.Type, s.Field, s.Reason)
+}
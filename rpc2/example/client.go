@@ -7,28 +7,12 @@ import (
 	"github.com/maxtaco/go-framed-msgpack-rpc/rpc2"
 )
 
-type GenericClient interface {
-	Call(method string, arg interface{}, res interface{}) error
-}
-
-//---------------------------------------------------------------------
-
-type ArithClient struct {
-	GenericClient
-}
-
-func (a ArithClient) Add(arg AddArgs) (ret int, err error) {
-	err = a.Call("test.1.arith.add", arg, &ret)
-	return
-}
-
+// Broken calls a method the server doesn't have.
 func (a ArithClient) Broken() (err error) {
 	err = a.Call("test.1.arith.broken", nil, nil)
 	return
 }
 
-//---------------------------------------------------------------------
-
 type Client struct {
 	port int
 }
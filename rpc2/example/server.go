@@ -8,12 +8,14 @@ import (
 	"github.com/maxtaco/go-framed-msgpack-rpc/rpc2"
 )
 
+//go:generate go run ../../cmd/rpc2gen -i arith.json -o arith_gen.go
+
 type Server struct {
 	port int
 }
 
 type ArithServer struct {
-	c net.Conn
+	xp *rpc2.Transport
 }
 
 func (a *ArithServer) Add(args *AddArgs) (ret int, err error) {
@@ -21,8 +23,7 @@ func (a *ArithServer) Add(args *AddArgs) (ret int, err error) {
 	return
 }
 
-func (a *ArithServer) DivMod(args *DivModArgs) (ret *DivModRes, err error) {
-	ret = &DivModRes{}
+func (a *ArithServer) DivMod(args *DivModArgs) (ret DivModRes, err error) {
 	if args.B == 0 {
 		err = errors.New("Cannot divide by 0")
 	} else {
@@ -32,54 +33,6 @@ func (a *ArithServer) DivMod(args *DivModArgs) (ret *DivModRes, err error) {
 	return
 }
 
-//---------------------------------------------------------------
-// begin autogen code
-
-type AddArgs struct {
-	A int
-	B int
-}
-
-type DivModArgs struct {
-	A int
-	B int
-}
-
-type DivModRes struct {
-	Q int
-	R int
-}
-
-type ArithInferface interface {
-	Add(*AddArgs) (int, error)
-	DivMod(*DivModArgs) (*DivModRes, error)
-}
-
-func ArithProtocol(i ArithInferface) rpc2.Protocol {
-	return rpc2.Protocol{
-		Name: "test.1.arith",
-		Methods: map[string]rpc2.ServeHook{
-			"add": func(nxt rpc2.DecodeNext) (ret interface{}, err error) {
-				var args AddArgs
-				if err = nxt(&args); err == nil {
-					ret, err = i.Add(&args)
-				}
-				return
-			},
-			"divMod": func(nxt rpc2.DecodeNext) (ret interface{}, err error) {
-				var args DivModArgs
-				if err = nxt(&args); err == nil {
-					ret, err = i.DivMod(&args)
-				}
-				return
-			},
-		},
-	}
-}
-
-// end autogen code
-//---------------------------------------------------------------
-
 func (s *Server) Run(ready chan struct{}) (err error) {
 	var listener net.Listener
 	o := rpc2.SimpleLogOutput{}
@@ -89,15 +42,8 @@ func (s *Server) Run(ready chan struct{}) (err error) {
 		return
 	}
 	close(ready)
-	for {
-		var c net.Conn
-		if c, err = listener.Accept(); err != nil {
-			return
-		}
-		xp := rpc2.NewTransport(c, lf, nil)
-		srv := rpc2.NewServer(xp, nil)
-		srv.Register(ArithProtocol(&ArithServer{c}))
-		srv.Run(true)
-	}
-	return nil
+	srv := rpc2.NewListenerServer(listener, lf, nil, func(xp *rpc2.Transport) rpc2.Protocol {
+		return ArithProtocol(&ArithServer{xp})
+	})
+	return srv.Serve()
 }
@@ -0,0 +1,24 @@
+package rpc2
+
+import (
+	"context"
+)
+
+// Invoke calls method with req, and returns its result as a Res, so that
+// callers needn't allocate one and pass it in as an interface{}.
+func Invoke[Req, Res any](ctx context.Context, c *Client, method string, req Req) (res Res, err error) {
+	err = c.CallContext(ctx, method, req, &res)
+	return
+}
+
+// Handler adapts a typed function to a ContextServeHook, for use in
+// Protocol.ContextMethods. Each argument is decoded into a Req for it.
+func Handler[Req, Res any](f func(context.Context, Req) (Res, error)) ContextServeHook {
+	return func(ctx context.Context, nxt DecodeNext) (interface{}, error) {
+		var req Req
+		if err := nxt(&req); err != nil {
+			return nil, err
+		}
+		return f(ctx, req)
+	}
+}
@@ -0,0 +1,65 @@
+package rpc2
+
+import (
+	"context"
+)
+
+// CallInfo describes a call or notify to an interceptor.
+type CallInfo struct {
+	Method string
+	// Seqid is the call's sequence number. On the client side, it's only
+	// set once the call has been sent by the Invoker; it's always zero
+	// for notifies.
+	Seqid  int
+	Notify bool
+
+	// Metadata is the call's metadata. On the client side, interceptors
+	// can add to it before calling the Invoker; it's never nil for calls,
+	// and if it's still empty, the call goes out as a plain quad. Notifies
+	// carry no metadata.
+	Metadata Metadata
+
+	// ReplyMetadata is the reply's metadata. On the server side, it's
+	// nil if the caller sent no metadata, and can't take any back;
+	// otherwise interceptors can add to it. On the client side, it's set
+	// once the Invoker returns.
+	ReplyMetadata Metadata
+}
+
+// ServerInterceptor wraps the handling of every call and notify a Server
+// gets. It can look at or change the decoded argument by wrapping nxt,
+// and at the result and error that handler returns. It can also return
+// without calling handler at all, for instance to refuse a call that
+// isn't authorized; the argument then just goes undecoded.
+type ServerInterceptor func(ctx context.Context, info *CallInfo, nxt DecodeNext, handler ContextServeHook) (interface{}, error)
+
+// Invoker sends a call (or notify) and, for calls, waits for the reply to
+// be decoded into res.
+type Invoker func(ctx context.Context, arg interface{}, res interface{}) error
+
+// ClientInterceptor wraps every call and notify a Client makes. It can
+// change arg, look at res and the error once invoke returns, call invoke
+// more than once to retry, or not at all to fail the call locally.
+type ClientInterceptor func(ctx context.Context, info *CallInfo, arg interface{}, res interface{}, invoke Invoker) error
+
+// chainServer wraps hook in interceptors, the first being outermost.
+func chainServer(interceptors []ServerInterceptor, info *CallInfo, hook ContextServeHook) ContextServeHook {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, next := interceptors[i], hook
+		hook = func(ctx context.Context, nxt DecodeNext) (interface{}, error) {
+			return ic(ctx, info, nxt, next)
+		}
+	}
+	return hook
+}
+
+// chainClient wraps invoke in interceptors, the first being outermost.
+func chainClient(interceptors []ClientInterceptor, info *CallInfo, invoke Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, next := interceptors[i], invoke
+		invoke = func(ctx context.Context, arg interface{}, res interface{}) error {
+			return ic(ctx, info, arg, res, next)
+		}
+	}
+	return invoke
+}
@@ -0,0 +1,126 @@
+package rpc2
+
+import (
+	"context"
+	"sync"
+)
+
+// ServerOptions limit how many handlers a Server runs at once, so that a
+// client can't use up the server's memory by pipelining calls.
+type ServerOptions struct {
+	// MaxHandlers is the most calls and notifies served at once on this
+	// connection. Zero means no limit.
+	MaxHandlers int
+
+	// Shared, if set, is a limit shared with other Servers, like all the
+	// connections of a ListenerServer.
+	Shared *HandlerLimit
+
+	// MaxQueued is how many requests can wait for a handler once a
+	// limit is reached. Any more are refused: calls get a
+	// ServerBusyError, and notifies are dropped. Zero refuses them right
+	// away, and a negative number lets the queue grow without bound.
+	MaxQueued int
+}
+
+// HandlerLimit is a limit on how many handlers run at once, which can be
+// shared between Servers. A nil *HandlerLimit is no limit at all.
+type HandlerLimit struct {
+	slots chan struct{}
+}
+
+func NewHandlerLimit(n int) *HandlerLimit {
+	return &HandlerLimit{slots: make(chan struct{}, n)}
+}
+
+func (h *HandlerLimit) tryAcquire() bool {
+	if h == nil {
+		return true
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *HandlerLimit) acquire(ctx context.Context) error {
+	if h == nil {
+		return nil
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *HandlerLimit) release() {
+	if h != nil {
+		<-h.slots
+	}
+}
+
+// limiter admits requests on one connection, as its ServerOptions say.
+type limiter struct {
+	conn      *HandlerLimit
+	shared    *HandlerLimit
+	maxQueued int
+	mutex     *sync.Mutex
+	queued    int
+}
+
+func newLimiter(opts ServerOptions) *limiter {
+	ret := &limiter{
+		shared:    opts.Shared,
+		maxQueued: opts.MaxQueued,
+		mutex:     new(sync.Mutex),
+	}
+	if opts.MaxHandlers > 0 {
+		ret.conn = NewHandlerLimit(opts.MaxHandlers)
+	}
+	return ret
+}
+
+// admit lets a request run right away if there's room. If not, it puts
+// the request in the queue, and returns the queue's new depth; the
+// request then has to wait before it runs. If the queue is full, it
+// returns a ServerBusyError.
+func (l *limiter) admit() (depth int, err error) {
+	if l.conn.tryAcquire() {
+		if l.shared.tryAcquire() {
+			return 0, nil
+		}
+		l.conn.release()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxQueued >= 0 && l.queued >= l.maxQueued {
+		return 0, ServerBusyError{}
+	}
+	l.queued++
+	return l.queued, nil
+}
+
+// wait takes a queued request out of the queue once it can run, or once
+// ctx is done, in which case it returns ctx.Err() and the request
+// shouldn't run.
+func (l *limiter) wait(ctx context.Context) (err error) {
+	if err = l.conn.acquire(ctx); err == nil {
+		if err = l.shared.acquire(ctx); err != nil {
+			l.conn.release()
+		}
+	}
+	l.mutex.Lock()
+	l.queued--
+	l.mutex.Unlock()
+	return
+}
+
+func (l *limiter) release() {
+	l.shared.release()
+	l.conn.release()
+}
@@ -0,0 +1,205 @@
+package rpc2
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ProtocolFactory makes a Protocol to serve on a newly-accepted
+// connection. It gets the connection's Transport, so that it can tell
+// connections apart, or make calls back to the client.
+type ProtocolFactory func(xp *Transport) Protocol
+
+// ListenerServer accepts connections from a net.Listener, and serves the
+// protocols made by its factories on each one. It keeps track of live
+// connections, and is shut down much like a net/http.Server.
+type ListenerServer struct {
+	listener  net.Listener
+	factories []ProtocolFactory
+	lf        LogFactory
+	wrapError WrapErrorFunc
+	opts      ServerOptions
+	metrics   Metrics
+	mutex     *sync.Mutex
+	conns     map[*Transport]*Server
+	closed    bool
+}
+
+func NewListenerServer(l net.Listener, lf LogFactory, wef WrapErrorFunc, factories ...ProtocolFactory) *ListenerServer {
+	return &ListenerServer{
+		listener:  l,
+		factories: factories,
+		lf:        lf,
+		wrapError: wef,
+		mutex:     new(sync.Mutex),
+		conns:     make(map[*Transport]*Server),
+	}
+}
+
+// Serve accepts connections until the listener is closed, or the server
+// is shut down, in which case it returns ServerClosedError. Other accept
+// errors, like running out of file descriptors, are retried after a
+// backoff of up to a second, as net/http does.
+func (s *ListenerServer) Serve() error {
+	var delay time.Duration
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ServerClosedError{}
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			s.getLog().Warning("Accept error: %s; retrying in %s", err.Error(), delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if err = s.serveConn(c); err != nil {
+			return err
+		}
+	}
+}
+
+// maxAcceptDelay is the longest Serve waits to retry a failed accept.
+const maxAcceptDelay = time.Second
+
+func (s *ListenerServer) getLog() LogInterface {
+	lf := s.lf
+	if lf == nil {
+		lf = NewSimpleLogFactory(nil, nil)
+	}
+	return lf.NewLog(s.listener.Addr())
+}
+
+func (s *ListenerServer) serveConn(c net.Conn) (err error) {
+	s.mutex.Lock()
+	opts, metrics := s.opts, s.metrics
+	s.mutex.Unlock()
+
+	xp := NewTransport(c, s.lf, s.wrapError)
+	if metrics != nil {
+		xp.SetMetrics(metrics)
+	}
+	srv := NewServerWithOptions(xp, s.wrapError, opts)
+	for _, f := range s.factories {
+		if err = srv.Register(f(xp)); err != nil {
+			c.Close()
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	closed := s.closed
+	if !closed {
+		s.conns[xp] = srv
+	}
+	s.mutex.Unlock()
+	if closed {
+		c.Close()
+		return ServerClosedError{}
+	}
+
+	go func() {
+		<-xp.Done()
+		s.mutex.Lock()
+		delete(s.conns, xp)
+		s.mutex.Unlock()
+	}()
+	return srv.Run(true)
+}
+
+// SetServerOptions sets the ServerOptions for connections accepted from
+// now on. To limit handlers across all connections, use opts.Shared.
+func (s *ListenerServer) SetServerOptions(opts ServerOptions) {
+	s.mutex.Lock()
+	s.opts = opts
+	s.mutex.Unlock()
+}
+
+// SetMetrics reports the calls and traffic of connections accepted from
+// now on to m.
+func (s *ListenerServer) SetMetrics(m Metrics) {
+	s.mutex.Lock()
+	s.metrics = m
+	s.mutex.Unlock()
+}
+
+func (s *ListenerServer) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// Transports returns the Transports for all live connections.
+func (s *ListenerServer) Transports() (ret []*Transport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for xp := range s.conns {
+		select {
+		case <-xp.Done():
+			// It's on its way out of s.conns.
+		default:
+			ret = append(ret, xp)
+		}
+	}
+	return
+}
+
+// stopListening closes the listener, so that Serve returns, and no new
+// connections are tracked.
+func (s *ListenerServer) stopListening() error {
+	s.mutex.Lock()
+	wasClosed := s.closed
+	s.closed = true
+	s.mutex.Unlock()
+	if wasClosed {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Shutdown stops accepting new connections, and then shuts down every
+// live connection gracefully, as Server.Shutdown does. If ctx is done
+// first, it returns ctx.Err(), and the connections that are left stay
+// open.
+func (s *ListenerServer) Shutdown(ctx context.Context) error {
+	err := s.stopListening()
+
+	s.mutex.Lock()
+	var srvs []*Server
+	for _, srv := range s.conns {
+		srvs = append(srvs, srv)
+	}
+	s.mutex.Unlock()
+
+	errs := make(chan error, len(srvs))
+	for _, srv := range srvs {
+		go func(srv *Server) { errs <- srv.Shutdown(ctx) }(srv)
+	}
+	for range srvs {
+		if e := <-errs; e == context.Canceled || e == context.DeadlineExceeded {
+			err = e
+		}
+	}
+	return err
+}
+
+// Close stops accepting new connections, and closes all live ones right
+// away.
+func (s *ListenerServer) Close() error {
+	err := s.stopListening()
+	for _, xp := range s.Transports() {
+		xp.Close()
+	}
+	return err
+}
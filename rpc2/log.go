@@ -25,6 +25,63 @@ type LogInterface interface {
 	Warning(format string, args ...interface{})
 }
 
+// NotifyLog can be implemented by a LogInterface to log notifies. The
+// dispatcher checks for it, and doesn't log notifies without it.
+type NotifyLog interface {
+	ServerNotifyCall(string, error, interface{})
+	ServerNotifyComplete(string, error)
+	ClientNotify(string, interface{})
+}
+
+// CancelLog can be implemented by a LogInterface to log TYPE_CANCEL
+// messages, sent and received.
+type CancelLog interface {
+	ServerCancelCall(int, string)
+	ClientCancel(int, string)
+}
+
+// LimitLog can be implemented by a LogInterface to log calls that are
+// queued, or refused, because of ServerOptions limits.
+type LimitLog interface {
+	ServerQueued(int, string, int)
+	ServerBusy(int, string)
+}
+
+// nopLog stands in for the optional parts of a LogInterface that a log
+// doesn't implement.
+type nopLog struct{}
+
+func (n nopLog) ServerNotifyCall(string, error, interface{}) {}
+func (n nopLog) ServerNotifyComplete(string, error)          {}
+func (n nopLog) ClientNotify(string, interface{})            {}
+func (n nopLog) ServerCancelCall(int, string)                {}
+func (n nopLog) ClientCancel(int, string)                    {}
+func (n nopLog) ServerQueued(int, string, int)               {}
+func (n nopLog) ServerBusy(int, string)                      {}
+
+func notifyLog(l LogInterface) NotifyLog {
+	if n, ok := l.(NotifyLog); ok {
+		return n
+	}
+	return nopLog{}
+}
+
+func cancelLog(l LogInterface) CancelLog {
+	if c, ok := l.(CancelLog); ok {
+		return c
+	}
+	return nopLog{}
+}
+
+func limitLog(l LogInterface) LimitLog {
+	if b, ok := l.(LimitLog); ok {
+		return b
+	}
+	return nopLog{}
+}
+
+// LogFactory makes a LogInterface for each new connection. The address
+// is nil for connections that don't have one, like unlabeled streams.
 type LogFactory interface {
 	NewLog(net.Addr) LogInterface
 }
@@ -147,6 +204,39 @@ func (s SimpleLog) ClientReply(q int, meth string, err error, res interface{}) {
 		s.trace("reply", "res", s.Opts.ShowResult(), q, meth, err, res)
 	}
 }
+func (s SimpleLog) ServerNotifyCall(meth string, err error, arg interface{}) {
+	if s.Opts.ServerTrace() {
+		s.trace("serve-notify", "arg", s.Opts.ShowArg(), 0, meth, err, arg)
+	}
+}
+func (s SimpleLog) ServerNotifyComplete(meth string, err error) {
+	if s.Opts.ServerTrace() {
+		s.trace("complete-notify", "", false, 0, meth, err, nil)
+	}
+}
+func (s SimpleLog) ClientNotify(meth string, arg interface{}) {
+	if s.Opts.ClientTrace() {
+		s.trace("notify", "arg", s.Opts.ShowArg(), 0, meth, nil, arg)
+	}
+}
+func (s SimpleLog) ServerCancelCall(q int, meth string) {
+	if s.Opts.ServerTrace() {
+		s.trace("serve-cancel", "", false, q, meth, nil, nil)
+	}
+}
+func (s SimpleLog) ServerQueued(q int, meth string, depth int) {
+	if s.Opts.ServerTrace() {
+		s.Out.Debug(s.msg(false, "queue(%d): method=%s; depth=%d;", q, meth, depth))
+	}
+}
+func (s SimpleLog) ServerBusy(q int, meth string) {
+	s.Out.Warning(s.msg(false, "Server busy; refused call %d to '%s'", q, meth))
+}
+func (s SimpleLog) ClientCancel(q int, meth string) {
+	if s.Opts.ClientTrace() {
+		s.trace("cancel", "", false, q, meth, nil, nil)
+	}
+}
 
 func (s SimpleLog) trace(which string, objname string, verbose bool, q int, meth string, err error, obj interface{}) {
 	args := []interface{}{which, q}
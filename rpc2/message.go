@@ -2,20 +2,25 @@ package rpc2
 
 import (
 	"errors"
+	"github.com/ugorji/go/codec"
 )
 
+// Message is one incoming message. It decodes from its own frame, so
+// handlers can decode their arguments whenever they like, without
+// holding up the rest of the connection.
 type Message struct {
 	t        Transporter
+	dec      *codec.Decoder
 	nFields  int
 	nDecoded int
 }
 
-func NewMessage(t Transporter, nFields int) Message {
-	return Message{t, nFields, 0}
+func NewMessage(t Transporter, dec *codec.Decoder, nFields int) Message {
+	return Message{t, dec, nFields, 0}
 }
 
 func (m *Message) Decode(i interface{}) (err error) {
-	err = m.t.Decode(i)
+	err = m.dec.Decode(i)
 	if err == nil {
 		m.nDecoded++
 	}
@@ -50,20 +55,34 @@ func (m *Message) decodeToNull() error {
 	var err error
 	for err == nil && m.nDecoded < m.nFields {
 		var i interface{}
-		m.Decode(&i)
+		err = m.Decode(&i)
 	}
 	return err
 }
 
+// takeTrailer decodes the message's last field into i, ahead of the
+// field before it, which is held back to be decoded as usual. Metadata
+// comes after a call's argument, but is needed before the handler gets
+// to decode the argument.
+func (m *Message) takeTrailer(i interface{}) (err error) {
+	var raw codec.Raw
+	if err = m.dec.Decode(&raw); err != nil {
+		return
+	}
+	if err = m.dec.Decode(i); err != nil {
+		return
+	}
+	m.dec.ResetBytes(raw)
+	m.nFields--
+	return
+}
+
 func (m *Message) makeDecodeNext(debugHook func(interface{})) DecodeNext {
-	// Reserve the next object
-	m.t.ReadLock()
 	return func(i interface{}) error {
 		ret := m.Decode(i)
 		if debugHook != nil {
 			debugHook(i)
 		}
-		m.t.ReadUnlock()
 		return ret
 	}
 }
@@ -0,0 +1,99 @@
+package rpc2
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Metadata is a set of string headers sent with a call or its reply, as
+// an optional fifth element of the message. Calls without any are sent
+// as plain quads, so peers that don't know about metadata are unaffected
+// until it's used.
+type Metadata map[string]string
+
+// MetadataTimeout is the key for the caller's remaining time, in
+// milliseconds, which is sent when ClientOptions.SendDeadlines is on. The
+// handler's context gets a matching deadline.
+const MetadataTimeout = "timeout-ms"
+
+type outgoingMetadataKey struct{}
+type incomingMetadataKey struct{}
+type replyMetadataKey struct{}
+
+// WithMetadata returns a copy of ctx, such that calls made with it carry
+// md.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingMetadataKey{}, md)
+}
+
+// outgoingMetadata returns a copy of the metadata attached to ctx by
+// WithMetadata, so that interceptors can add to it freely; it's never nil,
+// even if there's none. The trace context isn't in it: that's only added
+// by a Dispatch with a Tracer.
+func outgoingMetadata(ctx context.Context) (ret Metadata) {
+	md, _ := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	ret = make(Metadata, len(md)+1)
+	for k, v := range md {
+		ret[k] = v
+	}
+	return
+}
+
+// MetadataFromContext returns the metadata that came with the call being
+// handled, or nil if there wasn't any.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md
+}
+
+// SetReplyMetadata sets a header on the reply to the call being handled.
+// It returns false, and does nothing, if the caller didn't send any
+// metadata itself, since it might not understand any in the reply.
+func SetReplyMetadata(ctx context.Context, key string, value string) bool {
+	md, _ := ctx.Value(replyMetadataKey{}).(Metadata)
+	if md == nil {
+		return false
+	}
+	md[key] = value
+	return true
+}
+
+// addTimeout records the time left before ctx's deadline in md, if it
+// has one, and returns the (possibly new) metadata.
+func addTimeout(ctx context.Context, md Metadata) Metadata {
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := time.Until(deadline) / time.Millisecond
+		if ms < 1 {
+			ms = 1
+		}
+		md = md.with(MetadataTimeout, strconv.FormatInt(int64(ms), 10))
+	}
+	return md
+}
+
+// with returns a copy of md, with k set to v.
+func (md Metadata) with(k string, v string) Metadata {
+	ret := make(Metadata, len(md)+1)
+	for k, v := range md {
+		ret[k] = v
+	}
+	ret[k] = v
+	return ret
+}
+
+// handlerContext makes the context for handling a call that came with
+// md, and that can take replyMD back; both can be nil.
+func handlerContext(parent context.Context, md Metadata, replyMD Metadata) (context.Context, context.CancelFunc) {
+	if md == nil {
+		return context.WithCancel(parent)
+	}
+	ctx := context.WithValue(parent, incomingMetadataKey{}, md)
+	if replyMD != nil {
+		ctx = context.WithValue(ctx, replyMetadataKey{}, replyMD)
+	}
+	if ms, err := strconv.ParseInt(md[MetadataTimeout], 10, 64); err == nil && ms > 0 {
+		return context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,308 @@
+package rpc2
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Side says which end of a call is reporting it.
+type Side string
+
+const (
+	SideClient Side = "client"
+	SideServer Side = "server"
+)
+
+// Metrics is fed by Transports and their dispatchers as calls are made
+// and served. Implementations must be safe to call from many goroutines
+// at once; ExpvarMetrics is the standard one.
+type Metrics interface {
+	CallStarted(side Side, method string)
+	// CallFinished reports the outcome of a call (see Outcome), and how
+	// long it took.
+	CallFinished(side Side, method string, outcome string, d time.Duration)
+	// BytesReceived and BytesSent count the bytes in message frames,
+	// not counting their length prefixes.
+	BytesReceived(n int)
+	BytesSent(n int)
+	ConnectionOpened()
+	ConnectionClosed()
+}
+
+// Outcome sums up how a call went, from its error, for use as a metrics
+// label.
+func Outcome(err error) string {
+	switch err.(type) {
+	case nil:
+		return "ok"
+	case TimeoutError:
+		return "timeout"
+	case EofError, DisconnectedError:
+		return "disconnected"
+	case ServerBusyError:
+		return "busy"
+	case ShuttingDownError:
+		return "shutting_down"
+	case MethodNotFoundError, ProtocolNotFoundError:
+		return "not_found"
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return "canceled"
+	}
+	return "error"
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of
+// ExpvarMetrics' latency histograms.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []int64 // per bucket, plus one for +Inf
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets)+1)
+	}
+	s := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, s)
+	h.counts[i]++
+	h.count++
+	h.sum += s
+}
+
+type methodKey struct {
+	side   Side
+	method string
+}
+
+type methodStats struct {
+	started  int64
+	inFlight int64
+	finished map[string]int64
+	latency  histogram
+}
+
+// ExpvarMetrics keeps metrics in memory, publishes them through expvar,
+// and can serve them in the Prometheus text format.
+type ExpvarMetrics struct {
+	mutex       *sync.Mutex
+	methods     map[methodKey]*methodStats
+	bytesIn     int64
+	bytesOut    int64
+	connsOpen   int64
+	connsOpened int64
+}
+
+// NewExpvarMetrics makes a new ExpvarMetrics, published with expvar under
+// the given name, which, as usual with expvar, must be unique. If name is
+// empty, it's not published.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	ret := &ExpvarMetrics{
+		mutex:   new(sync.Mutex),
+		methods: make(map[methodKey]*methodStats),
+	}
+	if len(name) > 0 {
+		expvar.Publish(name, expvar.Func(ret.snapshot))
+	}
+	return ret
+}
+
+func (m *ExpvarMetrics) stats(side Side, method string) *methodStats {
+	k := methodKey{side, method}
+	s := m.methods[k]
+	if s == nil {
+		s = &methodStats{finished: make(map[string]int64)}
+		m.methods[k] = s
+	}
+	return s
+}
+
+func (m *ExpvarMetrics) CallStarted(side Side, method string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.stats(side, method)
+	s.started++
+	s.inFlight++
+}
+
+func (m *ExpvarMetrics) CallFinished(side Side, method string, outcome string, d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.stats(side, method)
+	s.inFlight--
+	s.finished[outcome]++
+	s.latency.observe(d)
+}
+
+func (m *ExpvarMetrics) BytesReceived(n int) {
+	m.mutex.Lock()
+	m.bytesIn += int64(n)
+	m.mutex.Unlock()
+}
+
+func (m *ExpvarMetrics) BytesSent(n int) {
+	m.mutex.Lock()
+	m.bytesOut += int64(n)
+	m.mutex.Unlock()
+}
+
+func (m *ExpvarMetrics) ConnectionOpened() {
+	m.mutex.Lock()
+	m.connsOpen++
+	m.connsOpened++
+	m.mutex.Unlock()
+}
+
+func (m *ExpvarMetrics) ConnectionClosed() {
+	m.mutex.Lock()
+	m.connsOpen--
+	m.mutex.Unlock()
+}
+
+// sortedKeys returns the keys of m.methods in a stable order. Call it with
+// the mutex held.
+func (m *ExpvarMetrics) sortedKeys() []methodKey {
+	keys := make([]methodKey, 0, len(m.methods))
+	for k := range m.methods {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].side != keys[j].side {
+			return keys[i].side < keys[j].side
+		}
+		return keys[i].method < keys[j].method
+	})
+	return keys
+}
+
+// snapshot returns the current metrics, in a form that expvar can turn
+// into JSON.
+func (m *ExpvarMetrics) snapshot() interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	type methodSnapshot struct {
+		Started        int64            `json:"started"`
+		InFlight       int64            `json:"in_flight"`
+		Finished       map[string]int64 `json:"finished"`
+		LatencySeconds float64          `json:"latency_seconds_sum"`
+	}
+	calls := make(map[string]map[string]methodSnapshot)
+	for _, k := range m.sortedKeys() {
+		s := m.methods[k]
+		if calls[string(k.side)] == nil {
+			calls[string(k.side)] = make(map[string]methodSnapshot)
+		}
+		finished := make(map[string]int64, len(s.finished))
+		for o, n := range s.finished {
+			finished[o] = n
+		}
+		calls[string(k.side)][k.method] = methodSnapshot{s.started, s.inFlight, finished, s.latency.sum}
+	}
+	return map[string]interface{}{
+		"calls":              calls,
+		"bytes_received":     m.bytesIn,
+		"bytes_sent":         m.bytesOut,
+		"connections_open":   m.connsOpen,
+		"connections_opened": m.connsOpened,
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition
+// format.
+func (m *ExpvarMetrics) WritePrometheus(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pw := &promWriter{w: w}
+	keys := m.sortedKeys()
+
+	pw.header("rpc2_calls_started_total", "counter", "Calls started, by side and method.")
+	for _, k := range keys {
+		pw.sample("rpc2_calls_started_total", labels(k), m.methods[k].started)
+	}
+	pw.header("rpc2_calls_finished_total", "counter", "Calls finished, by side, method and outcome.")
+	for _, k := range keys {
+		s := m.methods[k]
+		outcomes := make([]string, 0, len(s.finished))
+		for o := range s.finished {
+			outcomes = append(outcomes, o)
+		}
+		sort.Strings(outcomes)
+		for _, o := range outcomes {
+			pw.sample("rpc2_calls_finished_total", labels(k)+fmt.Sprintf(`,outcome=%q`, o), s.finished[o])
+		}
+	}
+	pw.header("rpc2_calls_in_flight", "gauge", "Calls in flight, by side and method.")
+	for _, k := range keys {
+		pw.sample("rpc2_calls_in_flight", labels(k), m.methods[k].inFlight)
+	}
+	pw.header("rpc2_call_duration_seconds", "histogram", "How long calls took, by side and method.")
+	for _, k := range keys {
+		h := m.methods[k].latency
+		var cum int64
+		for i, le := range latencyBuckets {
+			if h.counts != nil {
+				cum += h.counts[i]
+			}
+			pw.sample("rpc2_call_duration_seconds_bucket", labels(k)+fmt.Sprintf(`,le="%g"`, le), cum)
+		}
+		pw.sample("rpc2_call_duration_seconds_bucket", labels(k)+`,le="+Inf"`, h.count)
+		pw.sample("rpc2_call_duration_seconds_sum", labels(k), h.sum)
+		pw.sample("rpc2_call_duration_seconds_count", labels(k), h.count)
+	}
+	pw.header("rpc2_received_bytes_total", "counter", "Bytes received in message frames.")
+	pw.sample("rpc2_received_bytes_total", "", m.bytesIn)
+	pw.header("rpc2_sent_bytes_total", "counter", "Bytes sent in message frames.")
+	pw.sample("rpc2_sent_bytes_total", "", m.bytesOut)
+	pw.header("rpc2_connections_open", "gauge", "Connections open now.")
+	pw.sample("rpc2_connections_open", "", m.connsOpen)
+	pw.header("rpc2_connections_opened_total", "counter", "Connections opened.")
+	pw.sample("rpc2_connections_opened_total", "", m.connsOpened)
+	return pw.err
+}
+
+// PrometheusHandler returns an http.Handler that serves the metrics in
+// the Prometheus text exposition format.
+func (m *ExpvarMetrics) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WritePrometheus(w)
+	})
+}
+
+func labels(k methodKey) string {
+	return fmt.Sprintf(`side=%q,method=%q`, k.side, k.method)
+}
+
+// promWriter writes lines of Prometheus text, keeping the first error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) header(name string, typ string, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name string, labels string, v interface{}) {
+	if len(labels) > 0 {
+		p.printf("%s{%s} %v\n", name, labels, v)
+	} else {
+		p.printf("%s %v\n", name, v)
+	}
+}
@@ -1,25 +1,72 @@
 package rpc2
 
+import (
+	"github.com/ugorji/go/codec"
+)
+
+// DefaultMaxFrameSize is the largest frame a Packetizer accepts, unless
+// told otherwise with SetMaxFrameSize.
+const DefaultMaxFrameSize = 32 * 1024 * 1024
+
 type Packetizer struct {
-	dispatch  Dispatcher
-	transport Transporter
+	dispatch     Dispatcher
+	transport    Transporter
+	maxFrameSize int
+	mh           *codec.MsgpackHandle
+	skipper      *codec.Decoder
 }
 
 func NewPacketizer(d Dispatcher, t Transporter) *Packetizer {
+	// The skipper only measures frames, so it can look at them in place.
+	skip := newMsgpackHandle()
+	skip.ZeroCopy = true
+
 	return &Packetizer{
-		dispatch:  d,
-		transport: t,
+		dispatch:     d,
+		transport:    t,
+		maxFrameSize: DefaultMaxFrameSize,
+		mh:           newMsgpackHandle(),
+		skipper:      codec.NewDecoderBytes(nil, skip),
 	}
 }
 
-func (p *Packetizer) getFrame() (int, error) {
-	var l int
+// SetMaxFrameSize sets the largest frame we'll accept; bigger ones are
+// refused with a FrameSizeError before we read any of them. It should
+// be called before the Packetizer starts.
+func (p *Packetizer) SetMaxFrameSize(n int) {
+	p.maxFrameSize = n
+}
 
-	p.transport.ReadLock()
-	err := p.transport.Decode(&l)
-	p.transport.ReadUnlock()
+// getFrame reads a whole frame off the wire, so that its Message can be
+// decoded later without holding up the next one.
+func (p *Packetizer) getFrame() (frame []byte, err error) {
+	var l int
+	if err = p.transport.Decode(&l); err != nil {
+		return
+	}
+	if l < 0 || l > p.maxFrameSize {
+		return nil, FrameSizeError{Declared: l, Max: p.maxFrameSize}
+	}
+	frame = make([]byte, l)
+	if err = p.transport.ReadFull(frame); err != nil {
+		return
+	}
+	return frame, p.checkFrame(frame)
+}
 
-	return l, err
+// checkFrame makes sure the frame holds exactly one object, so that a
+// bad frame is caught here, rather than by whichever handler happens to
+// decode the end of it.
+func (p *Packetizer) checkFrame(frame []byte) error {
+	var r codec.Raw
+	p.skipper.ResetBytes(frame)
+	if err := p.skipper.Decode(&r); err != nil {
+		return FrameSizeError{Declared: len(frame), Consumed: len(frame) + 1}
+	}
+	if len(r) != len(frame) {
+		return FrameSizeError{Declared: len(frame), Consumed: len(r)}
+	}
+	return nil
 }
 
 func (p *Packetizer) Clear() {
@@ -27,16 +74,12 @@ func (p *Packetizer) Clear() {
 	p.transport = nil
 }
 
-func (p *Packetizer) getMessage(l int) (err error) {
-	var b byte
-
-	if b, err = p.transport.ReadByte(); err != nil {
-		return err
-	}
-	nb := int(b)
+func (p *Packetizer) getMessage(frame []byte) (err error) {
+	nb := int(frame[0])
 
 	if nb >= 0x91 && nb <= 0x9f {
-		err = p.dispatch.Dispatch(&Message{p.transport, (nb - 0x90), 0})
+		dec := codec.NewDecoderBytes(frame[1:], p.mh)
+		err = p.dispatch.Dispatch(&Message{p.transport, dec, (nb - 0x90), 0})
 	} else {
 		err = NewPacketizerError("wrong message structure prefix (%d)", nb)
 	}
@@ -45,9 +88,9 @@ func (p *Packetizer) getMessage(l int) (err error) {
 }
 
 func (p *Packetizer) packetizeOne() (err error) {
-	var n int
-	if n, err = p.getFrame(); err == nil {
-		err = p.getMessage(n)
+	var frame []byte
+	if frame, err = p.getFrame(); err == nil {
+		err = p.getMessage(frame)
 	}
 	return
 }
@@ -0,0 +1,321 @@
+package rpc2
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// DialFunc makes a new connection to the remote side.
+type DialFunc func() (net.Conn, error)
+
+// ReplayPolicy decides what happens to a call that's in flight when the
+// connection drops, or that's made while there's no connection.
+type ReplayPolicy int
+
+const (
+	// ReplayNever fails the call with an EofError (or a DisconnectedError
+	// if it was never sent).
+	ReplayNever ReplayPolicy = iota
+	// ReplayAlways sends the call again once there's a new connection.
+	// Only use it for methods that are safe to run more than once.
+	ReplayAlways
+)
+
+type ReconnectOptions struct {
+	// MinBackoff is how long to wait before the first redial; it
+	// doubles with every failed attempt, up to MaxBackoff. They default
+	// to 100ms and 30s respectively.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Replay holds the ReplayPolicy for individual methods, keyed by
+	// full method name. Methods not in it get DefaultReplay.
+	Replay        map[string]ReplayPolicy
+	DefaultReplay ReplayPolicy
+}
+
+// ReconnectingTransport is a Transporter that dials a new connection
+// whenever the old one goes away. All connections share one Dispatch,
+// so protocols and the EOF hook registered on it apply to every
+// connection, and seqids stay unique across reconnects.
+type ReconnectingTransport struct {
+	dial      DialFunc
+	lf        LogFactory
+	wrapError WrapErrorFunc
+	opts      ReconnectOptions
+	dispatch  *Dispatch
+	log       LogInterface
+	mutex     *sync.Mutex
+	xp        *Transport
+	metrics   Metrics
+	dialing   bool
+	closed    bool
+	closeCh   chan struct{}
+}
+
+// reconnectConn is the Dispatcher for one of a ReconnectingTransport's
+// connections. It hands incoming messages to the shared Dispatch, but
+// when the connection fails, it redials rather than resetting.
+type reconnectConn struct {
+	Dispatcher
+	r  *ReconnectingTransport
+	xp *Transport
+}
+
+func (c reconnectConn) Reset(err error) error {
+	c.r.connectionLost(c.xp, err)
+	return nil
+}
+
+// NewReconnectingTransport makes a new ReconnectingTransport. It doesn't
+// dial until Start is called, or the first call is made, so that
+// protocols and the EOF hook can be registered before any connection.
+func NewReconnectingTransport(dial DialFunc, l LogFactory, wef WrapErrorFunc, opts ReconnectOptions) *ReconnectingTransport {
+	if l == nil {
+		l = NewSimpleLogFactory(nil, nil)
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	ret := &ReconnectingTransport{
+		dial:      dial,
+		lf:        l,
+		wrapError: wef,
+		opts:      opts,
+		log:       l.NewLog(nil),
+		mutex:     new(sync.Mutex),
+		closeCh:   make(chan struct{}),
+	}
+	ret.dispatch = NewDispatch(ret, ret.log, wef)
+	ret.dispatch.replay = ret
+	return ret
+}
+
+// Start starts dialing in the background, if we aren't connected or
+// dialing already. Register protocols and the EOF hook before calling it.
+func (r *ReconnectingTransport) Start() {
+	r.redial()
+}
+
+func (r *ReconnectingTransport) shouldReplay(method string) bool {
+	r.mutex.Lock()
+	closed := r.closed
+	r.mutex.Unlock()
+	if closed {
+		return false
+	}
+	if p, found := r.opts.Replay[method]; found {
+		return p == ReplayAlways
+	}
+	return r.opts.DefaultReplay == ReplayAlways
+}
+
+func (r *ReconnectingTransport) replayPending() {
+	if r.IsConnected() {
+		r.dispatch.resendPending()
+	} else {
+		r.redial()
+	}
+}
+
+// redial starts dialing in the background, unless we're already dialing
+// or have been closed.
+func (r *ReconnectingTransport) redial() {
+	r.mutex.Lock()
+	start := !r.dialing && !r.closed && r.xp == nil
+	if start {
+		r.dialing = true
+	}
+	r.mutex.Unlock()
+	if start {
+		go r.dialLoop()
+	}
+}
+
+// backoff returns how long to wait after the given number of failed
+// attempts: an exponentially growing delay, of which a random half is
+// jitter, so that lots of clients don't all redial at once.
+func (r *ReconnectingTransport) backoff(attempt int) time.Duration {
+	d := r.opts.MaxBackoff
+	if attempt < 32 {
+		if e := r.opts.MinBackoff << uint(attempt); e > 0 && e < d {
+			d = e
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (r *ReconnectingTransport) dialLoop() {
+	for attempt := 0; ; attempt++ {
+		c, err := r.dial()
+		if err == nil {
+			r.connected(c)
+			return
+		}
+		r.log.Warning("Dial failed (attempt %d): %s", attempt+1, err.Error())
+		select {
+		case <-time.After(r.backoff(attempt)):
+		case <-r.closeCh:
+			r.mutex.Lock()
+			r.dialing = false
+			r.mutex.Unlock()
+			return
+		}
+	}
+}
+
+func (r *ReconnectingTransport) connected(c net.Conn) {
+	xp := newTransport(c, c.RemoteAddr(), r.lf, r.wrapError)
+	xp.setDispatcher(reconnectConn{r.dispatch, r, xp})
+
+	r.mutex.Lock()
+	xp.metrics = r.metrics
+	r.dialing = false
+	if r.closed {
+		r.mutex.Unlock()
+		c.Close()
+		return
+	}
+	r.xp = xp
+	r.mutex.Unlock()
+
+	xp.run(true)
+	r.dispatch.resendPending()
+}
+
+// connectionLost is called when xp's connection fails. Calls in flight are
+// failed or kept for replay as their ReplayPolicy says, and we start to
+// redial.
+func (r *ReconnectingTransport) connectionLost(xp *Transport, err error) {
+	r.mutex.Lock()
+	if r.xp == xp {
+		r.xp = nil
+	}
+	r.mutex.Unlock()
+	r.dispatch.Reset(err)
+	r.redial()
+}
+
+// Close shuts down the current connection, if any, and stops
+// reconnecting. Every outstanding call fails, whatever its
+// ReplayPolicy.
+func (r *ReconnectingTransport) Close() error {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.closeCh)
+	xp := r.xp
+	r.xp = nil
+	r.mutex.Unlock()
+
+	// Closing the connection resets the Dispatch once the packetizer
+	// notices; if there's no connection, we have to do it ourselves.
+	if xp != nil {
+		return xp.Close()
+	}
+	r.dispatch.Reset(DisconnectedError{})
+	return nil
+}
+
+func (r *ReconnectingTransport) IsConnected() bool {
+	_, err := r.getTransport()
+	return err == nil
+}
+
+// RegisterProtocol registers p to be served on every connection.
+func (r *ReconnectingTransport) RegisterProtocol(p Protocol) error {
+	return r.dispatch.RegisterProtocol(p)
+}
+
+// RegisterEOFHook registers a hook that's called every time a
+// connection goes away.
+func (r *ReconnectingTransport) RegisterEOFHook(h EOFHook) error {
+	return r.dispatch.RegisterEOFHook(h)
+}
+
+func (r *ReconnectingTransport) SetSendCancels(b bool) {
+	r.dispatch.SetSendCancels(b)
+}
+
+// SetTracer traces calls on every connection with t.
+func (r *ReconnectingTransport) SetTracer(t *Tracer) {
+	r.dispatch.SetTracer(t)
+}
+
+// SetMetrics reports calls, and the traffic and connections of new
+// connections, to m.
+func (r *ReconnectingTransport) SetMetrics(m Metrics) {
+	r.mutex.Lock()
+	r.metrics = m
+	r.mutex.Unlock()
+	r.dispatch.SetMetrics(m)
+}
+
+// SetLogPolicy controls how arguments and results are logged.
+func (r *ReconnectingTransport) SetLogPolicy(p LogPolicy) {
+	r.dispatch.SetLogPolicy(p)
+}
+
+func (r *ReconnectingTransport) getTransport() (*Transport, error) {
+	r.mutex.Lock()
+	xp := r.xp
+	r.mutex.Unlock()
+	if xp == nil || !xp.IsConnected() {
+		return nil, DisconnectedError{}
+	}
+	return xp, nil
+}
+
+// GetDispatcher returns the shared Dispatch, even while there's no
+// connection, so that calls made in the meantime can be replayed. It
+// only fails once the transport has been closed.
+func (r *ReconnectingTransport) GetDispatcher() (Dispatcher, error) {
+	r.mutex.Lock()
+	closed := r.closed
+	r.mutex.Unlock()
+	if closed {
+		return nil, DisconnectedError{}
+	}
+	r.redial()
+	return r.dispatch, nil
+}
+
+func (r *ReconnectingTransport) Encode(i interface{}) (err error) {
+	var xp *Transport
+	if xp, err = r.getTransport(); err == nil {
+		err = xp.Encode(i)
+	}
+	return
+}
+
+func (r *ReconnectingTransport) RawWrite(b []byte) (err error) {
+	var xp *Transport
+	if xp, err = r.getTransport(); err == nil {
+		err = xp.RawWrite(b)
+	}
+	return
+}
+
+func (r *ReconnectingTransport) ReadFull(b []byte) (err error) {
+	var xp *Transport
+	if xp, err = r.getTransport(); err == nil {
+		err = xp.ReadFull(b)
+	}
+	return
+}
+
+func (r *ReconnectingTransport) Decode(i interface{}) (err error) {
+	var xp *Transport
+	if xp, err = r.getTransport(); err == nil {
+		err = xp.Decode(i)
+	}
+	return
+}
@@ -0,0 +1,214 @@
+package rpc2
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// DefaultMaxLoggedBytes is how much of any one argument or result is
+// logged, as JSON, unless a LogPolicy says otherwise.
+const DefaultMaxLoggedBytes = 1024
+
+// Redacted is what's logged in place of a sensitive value.
+const Redacted = "[redacted]"
+
+// LogPolicy controls how arguments and results show up in logs. Whatever
+// the policy, struct fields tagged `rpc:"sensitive"` are always masked.
+type LogPolicy struct {
+	// MaxBytes is the most JSON logged for one argument or result; a
+	// longer one is cut short, and its full size noted. Zero means
+	// DefaultMaxLoggedBytes, and a negative number means no limit.
+	MaxBytes int
+
+	// SensitiveMethods are full method names (like "test.1.arith.add")
+	// whose arguments and results are never logged. They're masked on
+	// both sides of the connection; methods can also be marked sensitive
+	// in the Protocol that serves them.
+	SensitiveMethods []string
+}
+
+func (p LogPolicy) maxBytes() int {
+	if p.MaxBytes == 0 {
+		return DefaultMaxLoggedBytes
+	}
+	return p.MaxBytes
+}
+
+// LoggedValue is an argument or result on its way to the log. It's only
+// redacted and truncated if it's actually logged: as JSON, with
+// MarshalJSON, or by log/slog, with LogValue.
+type LoggedValue struct {
+	v         interface{}
+	sensitive bool
+	maxBytes  int
+}
+
+// Value returns what should be logged: Redacted if the whole value is
+// sensitive, or else a copy with its sensitive fields masked. If that's
+// too big, it's a string holding the start of its JSON, and its size.
+func (l LoggedValue) Value() interface{} {
+	if l.sensitive {
+		return Redacted
+	}
+	v := redact(reflect.ValueOf(l.v))
+	if l.maxBytes < 0 {
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil || len(b) <= l.maxBytes {
+		return v
+	}
+	return truncated(b, l.maxBytes)
+}
+
+func (l LoggedValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Value())
+}
+
+func (l LoggedValue) LogValue() slog.Value {
+	return slog.AnyValue(l.Value())
+}
+
+// truncated cuts b short, at a rune boundary at or before n bytes.
+func truncated(b []byte, n int) string {
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... (truncated; %d bytes)", b[:n], len(b))
+}
+
+// redact returns v, or if it has any fields tagged sensitive, a copy of it
+// made of maps and slices, with those fields masked. The copy marshals to
+// JSON like v would, give or take embedded structs.
+func redact(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if !mightBeSensitive(v.Type()) {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redact(v.Elem())
+	case reflect.Struct:
+		ret := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, ok := jsonName(f)
+			if !ok {
+				continue
+			}
+			if isSensitive(f) {
+				ret[name] = Redacted
+			} else {
+				ret[name] = redact(v.Field(i))
+			}
+		}
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		ret := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			ret[fmt.Sprint(iter.Key().Interface())] = redact(iter.Value())
+		}
+		return ret
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		ret := make([]interface{}, v.Len())
+		for i := range ret {
+			ret[i] = redact(v.Index(i))
+		}
+		return ret
+	}
+	return v.Interface()
+}
+
+func isSensitive(f reflect.StructField) bool {
+	for _, opt := range strings.Split(f.Tag.Get("rpc"), ",") {
+		if opt == "sensitive" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonName returns the name encoding/json would give f, and false if it
+// would leave it out.
+func jsonName(f reflect.StructField) (string, bool) {
+	if len(f.PkgPath) > 0 {
+		return "", false
+	}
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	switch name {
+	case "-":
+		return "", false
+	case "":
+		return f.Name, true
+	}
+	return name, true
+}
+
+var (
+	jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+	// sensitiveTypes caches mightBeSensitive, by reflect.Type.
+	sensitiveTypes sync.Map
+)
+
+// mightBeSensitive says whether values of type t could hold a field tagged
+// sensitive, so that redact has to look inside them. Interfaces might hold
+// anything. Types that marshal themselves are logged as they are.
+func mightBeSensitive(t reflect.Type) bool {
+	if b, ok := sensitiveTypes.Load(t); ok {
+		return b.(bool)
+	}
+	ret := scanSensitive(t, make(map[reflect.Type]bool))
+	sensitiveTypes.Store(t, ret)
+	return ret
+}
+
+func scanSensitive(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		// Recursive types are as sensitive as the rest of them says.
+		return false
+	}
+	seen[t] = true
+	if t.Implements(jsonMarshaler) || t.Implements(textMarshaler) {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return scanSensitive(t.Elem(), seen)
+	case reflect.Map:
+		return scanSensitive(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if _, ok := jsonName(f); !ok {
+				continue
+			}
+			if isSensitive(f) || scanSensitive(f.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
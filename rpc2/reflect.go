@@ -0,0 +1,223 @@
+package rpc2
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"unicode"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ProtocolFromValue makes a Protocol that serves the exported methods of
+// v, named in lower camel case, so that DivMod is served as "divMod".
+// Every method must look like one of:
+//
+//	func(*Arg) (Res, error)
+//	func(context.Context, *Arg) (Res, error)
+//
+// The argument needn't be a pointer, and the result can be left out, as
+// in func(*Arg) error. A method that doesn't fit is reported with a
+// ProtocolValueError. To serve methods with pointer receivers, pass a
+// pointer.
+func ProtocolFromValue(name string, v interface{}) (p Protocol, err error) {
+	val := reflect.ValueOf(v)
+	if !val.IsValid() {
+		return p, ProtocolValueError{Type: "nil", Reason: "it's nil"}
+	}
+	t := val.Type()
+	if t.NumMethod() == 0 {
+		return p, ProtocolValueError{Type: t.String(), Reason: "it has no exported methods"}
+	}
+
+	p = Protocol{
+		Name:           name,
+		Methods:        make(map[string]ServeHook),
+		ContextMethods: make(map[string]ContextServeHook),
+	}
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		h, withContext, reason := methodHook(val.Method(i))
+		if len(reason) > 0 {
+			return Protocol{}, ProtocolValueError{Type: t.String(), Method: m.Name, Reason: reason}
+		}
+		if withContext {
+			p.ContextMethods[lowerCamel(m.Name)] = h
+		} else {
+			p.Methods[lowerCamel(m.Name)] = func(nxt DecodeNext) (interface{}, error) {
+				return h(context.Background(), nxt)
+			}
+		}
+	}
+	return
+}
+
+// checkSignature says whether a func of type ft can be served or called:
+// if it takes a context, and otherwise, what's wrong with it.
+func checkSignature(ft reflect.Type) (withContext bool, reason string) {
+	withContext = ft.NumIn() > 0 && ft.In(0) == contextType
+	nArgs := ft.NumIn()
+	if withContext {
+		nArgs--
+	}
+	switch {
+	case ft.IsVariadic():
+		reason = "is variadic"
+	case nArgs != 1:
+		reason = fmt.Sprintf("takes %d arguments besides a context; want 1", nArgs)
+	case ft.NumOut() < 1 || ft.NumOut() > 2:
+		reason = fmt.Sprintf("returns %d values; want (Res, error) or error", ft.NumOut())
+	case ft.Out(ft.NumOut()-1) != errorType:
+		reason = fmt.Sprintf("returns %s last; want error", ft.Out(ft.NumOut()-1))
+	}
+	return
+}
+
+// newTarget allocates somewhere to decode a value of type t into. It
+// returns a pointer to pass to the decoder, and a way to get at the value
+// once it's decoded.
+func newTarget(t reflect.Type) (ptr interface{}, get func() reflect.Value) {
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		return v.Interface(), func() reflect.Value { return v }
+	}
+	v := reflect.New(t)
+	return v.Interface(), v.Elem
+}
+
+// methodHook adapts the method fn to a ContextServeHook, or says what's
+// wrong with its signature.
+func methodHook(fn reflect.Value) (h ContextServeHook, withContext bool, reason string) {
+	ft := fn.Type()
+	if withContext, reason = checkSignature(ft); len(reason) > 0 {
+		return
+	}
+
+	argType := ft.In(ft.NumIn() - 1)
+	h = func(ctx context.Context, nxt DecodeNext) (ret interface{}, err error) {
+		ptr, get := newTarget(argType)
+		if err = nxt(ptr); err != nil {
+			return
+		}
+		in := []reflect.Value{get()}
+		if withContext {
+			in = []reflect.Value{reflect.ValueOf(ctx), get()}
+		}
+		out := fn.Call(in)
+		if e := out[len(out)-1].Interface(); e != nil {
+			err = e.(error)
+		}
+		if len(out) == 2 {
+			ret = out[0].Interface()
+		}
+		return
+	}
+	return
+}
+
+type contextCaller interface {
+	CallContext(ctx context.Context, method string, arg interface{}, res interface{}) error
+}
+
+// BindClient fills in the func fields of the struct that stub points to,
+// so that each one calls the method of the protocol named after it, the
+// way ProtocolFromValue names them. Given
+//
+//	var arith struct {
+//		Add    func(*AddArgs) (int, error)
+//		DivMod func(context.Context, *DivModArgs) (DivModRes, error)
+//	}
+//
+// BindClient(cli, "test.1.arith", &arith) makes arith.DivMod call
+// "test.1.arith.divMod". A field tagged `rpc:"name"` calls that method
+// instead, and one tagged `rpc:"-"` is left alone. Fields that take a
+// context need a client with a CallContext method, like *Client.
+func BindClient(c GenericClient, protocol string, stub interface{}) error {
+	v := reflect.ValueOf(stub)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return StubError{Type: fmt.Sprintf("%T", stub), Reason: "it isn't a pointer to a struct"}
+	}
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("rpc")
+		if len(f.PkgPath) > 0 || name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = lowerCamel(f.Name)
+		}
+		fn, reason := stubFunc(c, protocol+"."+name, f.Type)
+		if len(reason) > 0 {
+			return StubError{Type: t.String(), Field: f.Name, Reason: reason}
+		}
+		v.Field(i).Set(fn)
+	}
+	return nil
+}
+
+// stubFunc makes a func of type ft that calls method with c, or says why
+// it can't.
+func stubFunc(c GenericClient, method string, ft reflect.Type) (fn reflect.Value, reason string) {
+	if ft.Kind() != reflect.Func {
+		return fn, "isn't a func"
+	}
+	withContext, reason := checkSignature(ft)
+	if len(reason) > 0 {
+		return
+	}
+	cc, ok := c.(contextCaller)
+	if withContext && !ok {
+		return fn, "takes a context, but the client can't"
+	}
+
+	var resType reflect.Type
+	if ft.NumOut() == 2 {
+		resType = ft.Out(0)
+	}
+	fn = reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+		arg := in[len(in)-1].Interface()
+		var res interface{}
+		var get func() reflect.Value
+		if resType != nil {
+			res, get = newTarget(resType)
+		}
+		var err error
+		if withContext {
+			err = cc.CallContext(in[0].Interface().(context.Context), method, arg, res)
+		} else {
+			err = c.Call(method, arg, res)
+		}
+		errVal := reflect.Zero(errorType)
+		if err != nil {
+			errVal = reflect.ValueOf(&err).Elem()
+		}
+		if resType == nil {
+			return []reflect.Value{errVal}
+		}
+		return []reflect.Value{get(), errVal}
+	})
+	return
+}
+
+// lowerCamel lower-cases the leading capitals of an exported name, but
+// for the one that starts the next word: DivMod is divMod, URLFor is
+// urlFor, and ID is id.
+func lowerCamel(s string) string {
+	r := []rune(s)
+	n := 0
+	for n < len(r) && unicode.IsUpper(r[n]) {
+		n++
+	}
+	if n > 1 && n < len(r) {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		r[i] = unicode.ToLower(r[i])
+	}
+	return string(r)
+}
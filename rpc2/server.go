@@ -1,5 +1,7 @@
 package rpc2
 
+import "context"
+
 type Server struct {
 	xp        *Transport
 	wrapError WrapErrorFunc
@@ -9,6 +11,13 @@ func NewServer(xp *Transport, f WrapErrorFunc) *Server {
 	return &Server{xp, f}
 }
 
+// NewServerWithOptions is like NewServer, but limits how many handlers
+// run at once, as opts say.
+func NewServerWithOptions(xp *Transport, f WrapErrorFunc, opts ServerOptions) *Server {
+	asDispatch(xp.dispatcher).SetServerOptions(opts)
+	return &Server{xp, f}
+}
+
 func (s *Server) Register(p Protocol) (err error) {
 	p.WrapError = s.wrapError
 	return s.xp.dispatcher.RegisterProtocol(p)
@@ -20,6 +29,29 @@ func (s *Server) RegisterEOFHook(h EOFHook) error {
 	return s.xp.dispatcher.RegisterEOFHook(h)
 }
 
+// Use adds an interceptor around every call and notify served from now
+// on. Interceptors run in the order they were added, the first outermost.
+func (s *Server) Use(i ServerInterceptor) {
+	asDispatch(s.xp.dispatcher).Use(i)
+}
+
 func (s *Server) Run(bg bool) error {
 	return s.xp.run(bg)
 }
+
+// Shutdown gracefully shuts down the connection. New calls are refused
+// with a ShuttingDownError, and once every running call has sent its
+// reply, the connection is closed. If ctx is done first, Shutdown
+// returns ctx.Err(), and leaves the connection open, still draining.
+func (s *Server) Shutdown(ctx context.Context) error {
+	d := s.xp.getDispatch()
+	if d == nil {
+		return nil
+	}
+	select {
+	case <-d.Drain():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.xp.Close()
+}
@@ -0,0 +1,279 @@
+package rpc2
+
+import (
+	"context"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// SlogOutput is a LogOutput that sends its lines to a *slog.Logger, with
+// Profile lines at the debug level.
+type SlogOutput struct {
+	Logger *slog.Logger
+}
+
+func (s SlogOutput) Error(f string, args ...interface{}) {
+	s.Logger.Error(fmt.Sprintf(f, args...))
+}
+func (s SlogOutput) Warning(f string, args ...interface{}) {
+	s.Logger.Warn(fmt.Sprintf(f, args...))
+}
+func (s SlogOutput) Info(f string, args ...interface{}) {
+	s.Logger.Info(fmt.Sprintf(f, args...))
+}
+func (s SlogOutput) Debug(f string, args ...interface{}) {
+	s.Logger.Debug(fmt.Sprintf(f, args...))
+}
+func (s SlogOutput) Profile(f string, args ...interface{}) {
+	s.Logger.Debug(fmt.Sprintf(f, args...))
+}
+
+// SlogFactory is a LogFactory whose logs go to a *slog.Logger as
+// structured records, with the remote address, seqid, method, error and
+// so on as attributes, rather than glued into the message.
+type SlogFactory struct {
+	logger *slog.Logger
+	opts   LogOptions
+}
+
+// NewSlogFactory makes a SlogFactory. The options say what to log, as
+// for SimpleLogFactory, except that the remote address is always
+// logged; nil opts log everything.
+func NewSlogFactory(l *slog.Logger, opts LogOptions) SlogFactory {
+	if opts == nil {
+		opts = SimpleLogOptions{}
+	}
+	return SlogFactory{l, opts}
+}
+
+func (s SlogFactory) NewLog(a net.Addr) LogInterface {
+	ret := SlogLog{
+		logger: s.logger.With(slog.String("remote", AddrToString(a))),
+		opts:   s.opts,
+		times:  newCallTimes(maxTimedCalls),
+	}
+	ret.TransportStart()
+	return ret
+}
+
+// SlogLog is the LogInterface made by SlogFactory. Reply records carry
+// the call's duration, since it was logged as served or sent.
+type SlogLog struct {
+	logger *slog.Logger
+	opts   LogOptions
+	times  *callTimes
+}
+
+// maxTimedCalls is how many calls a SlogLog times at once.
+const maxTimedCalls = 1024
+
+type callKey struct {
+	side  Side
+	seqid int
+}
+
+// callTimes remembers when calls started. It keeps only the most recent,
+// so that calls whose replies are never logged, like those abandoned by
+// their callers, don't pile up.
+type callTimes struct {
+	mutex  *sync.Mutex
+	starts map[callKey]time.Time
+	ring   []callKey
+	next   int
+}
+
+func newCallTimes(n int) *callTimes {
+	return &callTimes{
+		mutex:  new(sync.Mutex),
+		starts: make(map[callKey]time.Time),
+		ring:   make([]callKey, 0, n),
+	}
+}
+
+func (c *callTimes) start(side Side, seqid int) {
+	if c == nil {
+		return
+	}
+	k := callKey{side, seqid}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, found := c.starts[k]; !found {
+		if len(c.ring) < cap(c.ring) {
+			c.ring = append(c.ring, k)
+		} else {
+			delete(c.starts, c.ring[c.next])
+			c.ring[c.next] = k
+			c.next = (c.next + 1) % len(c.ring)
+		}
+	}
+	c.starts[k] = time.Now()
+}
+
+// since returns the duration attribute for a call that's done, and
+// forgets it; there's none if the call's start wasn't logged.
+func (c *callTimes) since(side Side, seqid int) []slog.Attr {
+	if c == nil {
+		return nil
+	}
+	k := callKey{side, seqid}
+	c.mutex.Lock()
+	start, found := c.starts[k]
+	delete(c.starts, k)
+	c.mutex.Unlock()
+	if !found {
+		return nil
+	}
+	return []slog.Attr{slog.Duration("duration", time.Since(start))}
+}
+
+var sizeHandle = newMsgpackHandle()
+
+// encodedSize returns the size of v, encoded as it would be on the wire,
+// or -1 if it can't be encoded. Sensitive values are still measured.
+func encodedSize(v interface{}) int {
+	if l, ok := v.(LoggedValue); ok {
+		v = l.v
+	}
+	var n countingWriter
+	if err := codec.NewEncoder(&n, sizeHandle).Encode(v); err != nil {
+		return -1
+	}
+	return int(n)
+}
+
+type countingWriter int
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	*c += countingWriter(len(b))
+	return len(b), nil
+}
+
+func (s SlogLog) debugEnabled() bool {
+	return s.logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// trace logs a call event at the debug level. The object, an argument or
+// result, is logged with its size, and itself if verbose.
+func (s SlogLog) trace(which string, q int, meth string, err error, objname string, obj interface{}, verbose bool, extra ...slog.Attr) {
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	attrs := append([]slog.Attr{slog.Int("seqid", q), slog.String("method", meth)}, extra...)
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	if len(objname) > 0 {
+		attrs = append(attrs, slog.Int(objname+"_size", encodedSize(obj)))
+		if verbose {
+			attrs = append(attrs, slog.Any(objname, obj))
+		}
+	}
+	s.logger.LogAttrs(ctx, slog.LevelDebug, which, attrs...)
+}
+
+func (s SlogLog) TransportStart() {
+	if s.opts.TransportStart() {
+		s.logger.Info("new connection")
+	}
+}
+
+func (s SlogLog) TransportError(e error) {
+	if e != io.EOF {
+		s.logger.Error("transport error", slog.String("error", e.Error()))
+	} else if s.opts.TransportStart() {
+		s.logger.Info("EOF")
+	}
+}
+
+func (s SlogLog) ServerCall(q int, meth string, err error, arg interface{}) {
+	if s.opts.ServerTrace() && s.debugEnabled() {
+		s.times.start(SideServer, q)
+		s.trace("serve", q, meth, err, "arg", arg, s.opts.ShowArg())
+	}
+}
+func (s SlogLog) ServerReply(q int, meth string, err error, res interface{}) {
+	if s.opts.ServerTrace() {
+		s.trace("reply", q, meth, err, "res", res, s.opts.ShowResult(), s.times.since(SideServer, q)...)
+	}
+}
+func (s SlogLog) ClientCall(q int, meth string, arg interface{}) {
+	if s.opts.ClientTrace() && s.debugEnabled() {
+		s.times.start(SideClient, q)
+		s.trace("call", q, meth, nil, "arg", arg, s.opts.ShowArg())
+	}
+}
+func (s SlogLog) ClientReply(q int, meth string, err error, res interface{}) {
+	if s.opts.ClientTrace() {
+		s.trace("reply", q, meth, err, "res", res, s.opts.ShowResult(), s.times.since(SideClient, q)...)
+	}
+}
+func (s SlogLog) ServerNotifyCall(meth string, err error, arg interface{}) {
+	if s.opts.ServerTrace() {
+		s.trace("serve-notify", 0, meth, err, "arg", arg, s.opts.ShowArg())
+	}
+}
+func (s SlogLog) ServerNotifyComplete(meth string, err error) {
+	if s.opts.ServerTrace() {
+		s.trace("complete-notify", 0, meth, err, "", nil, false)
+	}
+}
+func (s SlogLog) ClientNotify(meth string, arg interface{}) {
+	if s.opts.ClientTrace() {
+		s.trace("notify", 0, meth, nil, "arg", arg, s.opts.ShowArg())
+	}
+}
+func (s SlogLog) ServerCancelCall(q int, meth string) {
+	if s.opts.ServerTrace() {
+		s.trace("serve-cancel", q, meth, nil, "", nil, false)
+	}
+}
+func (s SlogLog) ServerQueued(q int, meth string, depth int) {
+	if s.opts.ServerTrace() {
+		s.logger.Debug("queue", slog.Int("seqid", q), slog.String("method", meth), slog.Int("depth", depth))
+	}
+}
+func (s SlogLog) ServerBusy(q int, meth string) {
+	s.logger.Warn("server busy; refused call", slog.Int("seqid", q), slog.String("method", meth))
+}
+func (s SlogLog) ClientCancel(q int, meth string) {
+	if s.opts.ClientTrace() {
+		// The reply, if it comes, won't be logged.
+		s.times.since(SideClient, q)
+		s.trace("cancel", q, meth, nil, "", nil, false)
+	}
+}
+
+func (s SlogLog) StartProfiler(format string, args ...interface{}) Profiler {
+	if !s.opts.Profile() {
+		return nil
+	}
+	return slogProfiler{
+		start: time.Now(),
+		msg:   fmt.Sprintf(format, args...),
+		log:   s,
+	}
+}
+
+func (s SlogLog) UnexpectedReply(seqno int) {
+	s.logger.Warn("unexpected seqno in incoming reply", slog.Int("seqid", seqno))
+}
+
+func (s SlogLog) Warning(format string, args ...interface{}) {
+	s.logger.Warn(fmt.Sprintf(format, args...))
+}
+
+type slogProfiler struct {
+	start time.Time
+	msg   string
+	log   SlogLog
+}
+
+func (s slogProfiler) Stop() {
+	s.log.logger.Debug("profile", slog.String("what", s.msg), slog.Duration("duration", time.Since(s.start)))
+}
@@ -0,0 +1,210 @@
+package rpc2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetadataTraceparent is the metadata key that carries trace context
+// from caller to callee, in the W3C traceparent format.
+const MetadataTraceparent = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID string // 32 hex digits
+	SpanID  string // 16 hex digits
+	Sampled bool
+}
+
+func (s SpanContext) traceparent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+// parseTraceparent parses a traceparent header, as the W3C spec says:
+// fields of lowercase hex, with IDs that aren't all zeros, and the
+// version, "ff", that's never valid. Later versions can add fields.
+func parseTraceparent(s string) (ret SpanContext, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) ||
+		!isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) ||
+		isZeros(parts[1]) || isZeros(parts[2]) {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags&1 == 1}, true
+}
+
+// isHex says whether s is n lowercase hex digits.
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZeros(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of ctx in which calls are made as
+// children of sc, on connections with a Tracer. Handlers get a context
+// like this for their own span, so calls they make with it stay in the
+// trace.
+func ContextWithSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanFromContext returns the span that calls made with ctx are children
+// of, if any.
+func SpanFromContext(ctx context.Context) (sc SpanContext, ok bool) {
+	sc, ok = ctx.Value(spanContextKey{}).(SpanContext)
+	return
+}
+
+// Span is a finished client or server span.
+type Span struct {
+	TraceID  string    `json:"trace_id"`
+	SpanID   string    `json:"span_id"`
+	ParentID string    `json:"parent_id,omitempty"`
+	Kind     string    `json:"kind"`
+	Method   string    `json:"method"`
+	Seqid    int       `json:"seqid"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Error    string    `json:"error,omitempty"`
+}
+
+const (
+	SpanKindClient = "client"
+	SpanKindServer = "server"
+)
+
+// SpanExporter is where a Tracer sends its sampled spans once they've
+// finished. It must be safe to call from many goroutines at once.
+type SpanExporter interface {
+	ExportSpan(Span)
+}
+
+// Tracer makes spans for calls and the handling of calls, and passes the
+// trace context along in metadata, so a trace can follow a request
+// through several processes.
+type Tracer struct {
+	exporter SpanExporter
+	fraction float64
+}
+
+// NewTracer makes a Tracer that exports to e. New traces are sampled
+// with probability fraction; other spans are sampled if their parent was.
+func NewTracer(e SpanExporter, fraction float64) *Tracer {
+	return &Tracer{exporter: e, fraction: fraction}
+}
+
+func newID(words int) string {
+	var b strings.Builder
+	for i := 0; i < words; i++ {
+		fmt.Fprintf(&b, "%016x", rand.Uint64())
+	}
+	return b.String()
+}
+
+// activeSpan is a span that's been started, but not yet finished.
+type activeSpan struct {
+	tracer  *Tracer
+	span    Span
+	sampled bool
+}
+
+// startSpan starts a span as a child of the one in traceparent, or at the
+// root of a new trace if there's none. A nil Tracer makes no spans.
+func (t *Tracer) startSpan(kind string, method string, seqid int, traceparent string) *activeSpan {
+	if t == nil {
+		return nil
+	}
+	parent, ok := parseTraceparent(traceparent)
+	if !ok {
+		parent = SpanContext{TraceID: newID(2), Sampled: rand.Float64() < t.fraction}
+	}
+	return &activeSpan{
+		tracer:  t,
+		sampled: parent.Sampled,
+		span: Span{
+			TraceID:  parent.TraceID,
+			SpanID:   newID(1),
+			ParentID: parent.SpanID,
+			Kind:     kind,
+			Method:   method,
+			Seqid:    seqid,
+			Start:    time.Now(),
+		},
+	}
+}
+
+func (a *activeSpan) context() SpanContext {
+	return SpanContext{TraceID: a.span.TraceID, SpanID: a.span.SpanID, Sampled: a.sampled}
+}
+
+// inject returns a copy of md with a's context in it. md itself is left
+// alone, since the caller might send it again, say on a retry.
+func (a *activeSpan) inject(md Metadata) Metadata {
+	return md.with(MetadataTraceparent, a.context().traceparent())
+}
+
+func (a *activeSpan) finish(err error) {
+	if a == nil || !a.sampled {
+		return
+	}
+	a.span.End = time.Now()
+	if err != nil {
+		a.span.Error = err.Error()
+	}
+	a.tracer.exporter.ExportSpan(a.span)
+}
+
+// JSONLinesExporter writes spans as JSON, one per line, for instance to a
+// file, to be looked at later.
+type JSONLinesExporter struct {
+	mutex *sync.Mutex
+	enc   *json.Encoder
+	err   error
+}
+
+func NewJSONLinesExporter(w io.Writer) *JSONLinesExporter {
+	return &JSONLinesExporter{mutex: new(sync.Mutex), enc: json.NewEncoder(w)}
+}
+
+func (j *JSONLinesExporter) ExportSpan(s Span) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if err := j.enc.Encode(s); err != nil && j.err == nil {
+		j.err = err
+	}
+}
+
+// Err returns the first error writing a span, if there was one.
+func (j *JSONLinesExporter) Err() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.err
+}
@@ -2,11 +2,11 @@ package rpc2
 
 import (
 	"bufio"
-	"bytes"
 	"github.com/ugorji/go/codec"
-	"io/ioutil"
+	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 type WrapErrorFunc func(error) interface{}
@@ -14,17 +14,15 @@ type UnwrapErrorFunc func(nxt DecodeNext) (error, error)
 
 type Transporter interface {
 	RawWrite([]byte) error
-	ReadByte() (byte, error)
+	ReadFull([]byte) error
 	Decode(interface{}) error
 	Encode(interface{}) error
 	GetDispatcher() (Dispatcher, error)
-	ReadLock()
-	ReadUnlock()
 }
 
 type ConPackage struct {
 	Decoder
-	con        net.Conn
+	con        io.ReadWriteCloser
 	remoteAddr net.Addr
 	br         *bufio.Reader
 }
@@ -33,6 +31,11 @@ func (c *ConPackage) ReadByte() (b byte, e error) {
 	return c.br.ReadByte()
 }
 
+func (c *ConPackage) ReadFull(b []byte) (err error) {
+	_, err = io.ReadFull(c.br, b)
+	return
+}
+
 func (c *ConPackage) Write(b []byte) (err error) {
 	_, err = c.con.Write(b)
 	return
@@ -49,29 +52,44 @@ func (c *ConPackage) GetRemoteAddr() net.Addr {
 type Transport struct {
 	mh         *codec.MsgpackHandle
 	cpkg       *ConPackage
-	buf        *bytes.Buffer
-	enc        *codec.Encoder
+	encoders   *sync.Pool
 	mutex      *sync.Mutex
-	rdlck      *sync.Mutex
 	wrlck      *sync.Mutex
+	coalesce   time.Duration
+	batch      *writeBatch
 	dispatcher Dispatcher
 	packetizer *Packetizer
 	log        LogInterface
 	running    bool
 	wrapError  WrapErrorFunc
+	metrics    Metrics
+	done       chan struct{}
 }
 
 func NewConPackage(c net.Conn, mh *codec.MsgpackHandle) *ConPackage {
+	return NewStreamConPackage(c, c.RemoteAddr(), mh)
+}
+
+// NewStreamConPackage is like NewConPackage, but works over any byte
+// stream. The address is only used for logging, and can be nil.
+func NewStreamConPackage(c io.ReadWriteCloser, addr net.Addr, mh *codec.MsgpackHandle) *ConPackage {
 	br := bufio.NewReader(c)
 
 	return &ConPackage{
 		con:        c,
-		remoteAddr: c.RemoteAddr(),
+		remoteAddr: addr,
 		br:         br,
 		Decoder:    codec.NewDecoder(br, mh),
 	}
 }
 
+// StreamAddr labels a connection that isn't a network socket, like a
+// pipe or a child process's stdin and stdout.
+type StreamAddr string
+
+func (s StreamAddr) Network() string { return "stream" }
+func (s StreamAddr) String() string  { return string(s) }
+
 func (t *Transport) IsConnected() bool {
 	t.mutex.Lock()
 	ret := (t.cpkg != nil)
@@ -79,57 +97,77 @@ func (t *Transport) IsConnected() bool {
 	return ret
 }
 
+// GetRemoteAddr returns the address of the remote side. It's nil if
+// we're disconnected, or for a stream transport made without a label.
 func (t *Transport) GetRemoteAddr() (ret net.Addr) {
-	if t.cpkg != nil {
-		ret = t.cpkg.GetRemoteAddr()
+	if cp, err := t.getConPackage(); err == nil {
+		ret = cp.GetRemoteAddr()
 	}
 	return
 }
 
 func NewTransport(c net.Conn, l LogFactory, wef WrapErrorFunc) *Transport {
-	mh := codec.MsgpackHandle{WriteExt: true}
+	ret := newTransport(c, c.RemoteAddr(), l, wef)
+	ret.setDispatcher(NewDispatch(ret, ret.log, wef))
+	return ret
+}
+
+// NewStreamTransport makes a Transport over any byte stream, like
+// os.Pipe, or a child process's stdin and stdout. The label shows up in
+// logs as a StreamAddr; if it's empty, the Transport has no address.
+func NewStreamTransport(c io.ReadWriteCloser, label string, l LogFactory, wef WrapErrorFunc) *Transport {
+	var addr net.Addr
+	if len(label) > 0 {
+		addr = StreamAddr(label)
+	}
+	ret := newTransport(c, addr, l, wef)
+	ret.setDispatcher(NewDispatch(ret, ret.log, wef))
+	return ret
+}
+
+// newTransport makes a Transport without a Dispatcher, leaving it to the
+// caller to supply one with setDispatcher.
+func newTransport(c io.ReadWriteCloser, addr net.Addr, l LogFactory, wef WrapErrorFunc) *Transport {
+	mh := newMsgpackHandle()
 
-	buf := new(bytes.Buffer)
 	ret := &Transport{
-		mh:        &mh,
-		cpkg:      NewConPackage(c, &mh),
-		buf:       buf,
-		enc:       codec.NewEncoder(buf, &mh),
+		mh:        mh,
+		cpkg:      NewStreamConPackage(c, addr, mh),
+		encoders:  newFrameEncoderPool(mh),
 		mutex:     new(sync.Mutex),
-		rdlck:     new(sync.Mutex),
 		wrlck:     new(sync.Mutex),
 		wrapError: wef,
+		done:      make(chan struct{}),
 	}
 	if l == nil {
 		l = NewSimpleLogFactory(nil, nil)
 	}
-	log := l.NewLog(ret.cpkg.GetRemoteAddr())
-	ret.log = log
-	ret.dispatcher = NewDispatch(ret, log, wef)
-	ret.packetizer = NewPacketizer(ret.dispatcher, ret)
+	ret.log = l.NewLog(ret.cpkg.GetRemoteAddr())
 	return ret
 }
 
-func (t *Transport) ReadLock()   { t.rdlck.Lock() }
-func (t *Transport) ReadUnlock() { t.rdlck.Unlock() }
-
-func (t *Transport) encodeToBytes(i interface{}) (v []byte, err error) {
-	if err = t.enc.Encode(i); err != nil {
-		return
-	}
-	v, _ = ioutil.ReadAll(t.buf)
-	return
+func (t *Transport) setDispatcher(d Dispatcher) {
+	t.dispatcher = d
+	t.packetizer = NewPacketizer(d, t)
 }
 
 func (t *Transport) run2() (err error) {
+	m := t.getMetrics()
+	if m != nil {
+		m.ConnectionOpened()
+	}
 	err = t.packetizer.Packetize()
 	t.handlePacketizerFailure(err)
+	if m != nil {
+		m.ConnectionClosed()
+	}
+	close(t.done)
 	return
 }
 
 func (t *Transport) handlePacketizerFailure(err error) {
-	// For now, just throw everything away.  Eventually we might
-	// want to make a plan for reconnecting.
+	// Throw everything away. If we're one connection of a
+	// ReconnectingTransport, the dispatcher's Reset will redial.
 	t.mutex.Lock()
 	t.running = false
 	t.dispatcher.Reset(err)
@@ -167,22 +205,18 @@ func (t *Transport) run(bg bool) (err error) {
 	return
 }
 
+// Encode frames i and writes it to the connection in one go. Concurrent
+// Encodes only contend for the write itself.
 func (t *Transport) Encode(i interface{}) (err error) {
-	t.wrlck.Lock()
-	defer t.wrlck.Unlock()
-
-	var v1, v2 []byte
-	if v2, err = t.encodeToBytes(i); err != nil {
-		return
-	}
-	l := len(v2)
-	if v1, err = t.encodeToBytes(l); err != nil {
+	fe := t.getFrameEncoder()
+	var frame []byte
+	if frame, err = fe.encode(i); err != nil {
+		// Don't reuse an encoder that failed halfway.
 		return
 	}
-	if err = t.RawWrite(v1); err != nil {
-		return
-	}
-	return t.RawWrite(v2)
+	err = t.writeFrame(frame)
+	t.putFrameEncoder(fe)
+	return
 }
 
 func (t *Transport) getConPackage() (ret *ConPackage, err error) {
@@ -195,10 +229,33 @@ func (t *Transport) getConPackage() (ret *ConPackage, err error) {
 	return
 }
 
-func (t *Transport) ReadByte() (b byte, err error) {
+// Close closes the connection, and waits for the Transport to be torn
+// down: outstanding calls have failed, the EOF hook has run, and the
+// packetizer goroutine has exited.
+func (t *Transport) Close() (err error) {
+	if cp, e := t.getConPackage(); e == nil {
+		err = cp.Close()
+	}
+	// If the packetizer was never started, this runs it to its failure
+	// on the closed connection; otherwise, it does nothing.
+	t.run(false)
+	<-t.done
+	return
+}
+
+// Done returns a channel that's closed once the Transport has been torn
+// down, after its connection fails or is closed.
+func (t *Transport) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *Transport) ReadFull(b []byte) (err error) {
 	var cp *ConPackage
 	if cp, err = t.getConPackage(); err == nil {
-		b, err = cp.ReadByte()
+		err = cp.ReadFull(b)
+	}
+	if m := t.getMetrics(); m != nil && err == nil {
+		m.BytesReceived(len(b))
 	}
 	return
 }
@@ -219,6 +276,82 @@ func (t *Transport) RawWrite(b []byte) (err error) {
 	return err
 }
 
+// SetSendCancels controls whether calls abandoned via their context are
+// announced to the remote side with a TYPE_CANCEL message. Only turn it
+// on if the remote side is known to understand TYPE_CANCEL.
+func (t *Transport) SetSendCancels(b bool) {
+	if d := t.getDispatch(); d != nil {
+		d.SetSendCancels(b)
+	}
+}
+
+// SetMaxFrameSize sets the largest incoming frame we'll accept, in
+// bytes; it's DefaultMaxFrameSize otherwise. A peer that sends a bigger
+// one is disconnected with a FrameSizeError. Call it before the
+// Transport starts running.
+func (t *Transport) SetMaxFrameSize(n int) {
+	t.mutex.Lock()
+	if t.packetizer != nil {
+		t.packetizer.SetMaxFrameSize(n)
+	}
+	t.mutex.Unlock()
+}
+
+// SetTracer traces calls made and served on this connection with t. Only
+// use it if the remote side understands metadata.
+func (t *Transport) SetTracer(tr *Tracer) {
+	if d := t.getDispatch(); d != nil {
+		d.SetTracer(tr)
+	}
+}
+
+// SetMetrics reports the calls made and served on this connection, and
+// its traffic, to m. Call it before the Transport starts running, so that
+// the connection is counted.
+func (t *Transport) SetMetrics(m Metrics) {
+	t.mutex.Lock()
+	t.metrics = m
+	t.mutex.Unlock()
+	if d := t.getDispatch(); d != nil {
+		d.SetMetrics(m)
+	}
+}
+
+// SetLogPolicy controls how the arguments and results of calls on this
+// connection are logged.
+func (t *Transport) SetLogPolicy(p LogPolicy) {
+	if d := t.getDispatch(); d != nil {
+		d.SetLogPolicy(p)
+	}
+}
+
+func (t *Transport) getMetrics() Metrics {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.metrics
+}
+
+// getDispatch returns the Dispatch behind the dispatcher, for the
+// settings that aren't part of the Dispatcher interface; it's nil if
+// we're disconnected.
+func (t *Transport) getDispatch() *Dispatch {
+	t.mutex.Lock()
+	d := t.dispatcher
+	t.mutex.Unlock()
+	return asDispatch(d)
+}
+
+// asDispatch returns the Dispatch behind d, or nil if there isn't one.
+func asDispatch(d Dispatcher) *Dispatch {
+	switch d := d.(type) {
+	case *Dispatch:
+		return d
+	case reconnectConn:
+		return asDispatch(d.Dispatcher)
+	}
+	return nil
+}
+
 func (t *Transport) GetDispatcher() (d Dispatcher, err error) {
 	t.run(true)
 	if !t.IsConnected() {
@@ -0,0 +1,133 @@
+package rpc2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/ugorji/go/codec"
+	"math"
+	"sync"
+	"time"
+)
+
+// frameHeaderLen is the length of the header on outgoing frames: the
+// body's length as a msgpack uint32, which every peer can decode, however
+// long the body.
+const frameHeaderLen = 5
+
+// maxPooledBuffer is the largest buffer we keep around for reuse; the
+// odd giant message shouldn't pin its memory forever.
+const maxPooledBuffer = 64 * 1024
+
+// maxCoalescedWrite is how big a batch of coalesced frames can get before
+// we write it without waiting out the budget.
+const maxCoalescedWrite = 64 * 1024
+
+// frameEncoder encodes messages straight into a frame, header and all, so
+// that each one can go out in a single write. A Transport keeps a pool of
+// them.
+type frameEncoder struct {
+	buf *bytes.Buffer
+	enc *codec.Encoder
+}
+
+func newFrameEncoderPool(mh *codec.MsgpackHandle) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := new(bytes.Buffer)
+			return &frameEncoder{buf: buf, enc: codec.NewEncoder(buf, mh)}
+		},
+	}
+}
+
+// encode returns i as a frame. The frame is only good until fe goes back
+// into the pool.
+func (fe *frameEncoder) encode(i interface{}) (frame []byte, err error) {
+	var header [frameHeaderLen]byte
+	fe.buf.Reset()
+	fe.buf.Write(header[:])
+	if err = fe.enc.Encode(i); err != nil {
+		return
+	}
+	frame = fe.buf.Bytes()
+	l := len(frame) - frameHeaderLen
+	if uint64(l) > math.MaxUint32 {
+		return nil, NewPacketizerError("message too big to frame (%d bytes)", l)
+	}
+	frame[0] = 0xce
+	binary.BigEndian.PutUint32(frame[1:], uint32(l))
+	return
+}
+
+// writeBatch is a run of frames from concurrent Encodes that go out in
+// one write.
+type writeBatch struct {
+	buf  []byte
+	done chan struct{}
+	err  error
+}
+
+func (t *Transport) getFrameEncoder() *frameEncoder {
+	return t.encoders.Get().(*frameEncoder)
+}
+
+func (t *Transport) putFrameEncoder(fe *frameEncoder) {
+	if fe.buf.Cap() <= maxPooledBuffer {
+		t.encoders.Put(fe)
+	}
+}
+
+// SetWriteCoalescing lets frames from concurrent Encodes share a write:
+// each one waits up to budget for others to join it, and Encode returns
+// once the whole batch has been written. The default, zero, writes every
+// frame as soon as it's encoded.
+func (t *Transport) SetWriteCoalescing(budget time.Duration) {
+	t.wrlck.Lock()
+	t.coalesce = budget
+	t.wrlck.Unlock()
+}
+
+// writeFrame writes a frame, on its own or in a batch. It holds wrlck, so
+// that frames never interleave.
+func (t *Transport) writeFrame(frame []byte) error {
+	if m := t.getMetrics(); m != nil {
+		m.BytesSent(len(frame) - frameHeaderLen)
+	}
+
+	t.wrlck.Lock()
+	if t.coalesce <= 0 {
+		err := t.RawWrite(frame)
+		t.wrlck.Unlock()
+		return err
+	}
+
+	b := t.batch
+	if b == nil {
+		b = &writeBatch{done: make(chan struct{})}
+		t.batch = b
+		time.AfterFunc(t.coalesce, func() { t.flushBatch(b) })
+	}
+	b.buf = append(b.buf, frame...)
+	if len(b.buf) >= maxCoalescedWrite {
+		t.writeBatch(b)
+	}
+	t.wrlck.Unlock()
+
+	<-b.done
+	return b.err
+}
+
+func (t *Transport) flushBatch(b *writeBatch) {
+	t.wrlck.Lock()
+	if t.batch == b {
+		t.writeBatch(b)
+	}
+	t.wrlck.Unlock()
+}
+
+// writeBatch writes out b, which must be the current batch. Call it with
+// wrlck held.
+func (t *Transport) writeBatch(b *writeBatch) {
+	t.batch = nil
+	b.err = t.RawWrite(b.buf)
+	close(b.done)
+}
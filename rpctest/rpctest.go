@@ -0,0 +1,74 @@
+// Package rpctest provides helpers for testing code that uses rpc2,
+// without binding real network ports.
+package rpctest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/maxtaco/go-framed-msgpack-rpc/rpc2"
+)
+
+// Pair is a client and a server Transport, connected to each other over
+// an in-memory pipe.
+type Pair struct {
+	Client *rpc2.Transport
+	Server *rpc2.Transport
+}
+
+type discardLogOutput struct{}
+
+func (d discardLogOutput) Error(s string, args ...interface{})   {}
+func (d discardLogOutput) Warning(s string, args ...interface{}) {}
+func (d discardLogOutput) Info(s string, args ...interface{})    {}
+func (d discardLogOutput) Debug(s string, args ...interface{})   {}
+func (d discardLogOutput) Profile(s string, args ...interface{}) {}
+
+// DiscardLogFactory returns a LogFactory that throws everything away,
+// to keep test output quiet.
+func DiscardLogFactory() rpc2.LogFactory {
+	return rpc2.NewSimpleLogFactory(discardLogOutput{}, nil)
+}
+
+// NewPair makes a new Pair. If lf is nil, logs are discarded.
+func NewPair(lf rpc2.LogFactory) *Pair {
+	if lf == nil {
+		lf = DiscardLogFactory()
+	}
+	c1, c2 := net.Pipe()
+	return &Pair{
+		Client: rpc2.NewTransport(c1, lf, nil),
+		Server: rpc2.NewTransport(c2, lf, nil),
+	}
+}
+
+// Serve registers the given protocols on the server side, and starts
+// serving them in the background.
+func (p *Pair) Serve(prots ...rpc2.Protocol) (err error) {
+	srv := rpc2.NewServer(p.Server, nil)
+	for _, prot := range prots {
+		if err = srv.Register(prot); err != nil {
+			return
+		}
+	}
+	return srv.Run(true)
+}
+
+// Close closes both ends, and only returns once both packetizer
+// goroutines have exited.
+func (p *Pair) Close() {
+	p.Client.Close()
+	p.Server.Close()
+}
+
+// NewClient returns a Client that's connected to a server for the given
+// protocols, ready for calls. The Pair is closed when the test finishes.
+func NewClient(tb testing.TB, prots ...rpc2.Protocol) *rpc2.Client {
+	tb.Helper()
+	p := NewPair(nil)
+	tb.Cleanup(p.Close)
+	if err := p.Serve(prots...); err != nil {
+		tb.Fatal(err)
+	}
+	return rpc2.NewClient(p.Client, nil)
+}
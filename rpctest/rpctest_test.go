@@ -0,0 +1,47 @@
+package rpctest
+
+import (
+	"testing"
+
+	"github.com/maxtaco/go-framed-msgpack-rpc/rpc2"
+)
+
+func TestPair(t *testing.T) {
+	p := NewPair(nil)
+	eof := make(chan error, 1)
+	rpc2.NewServer(p.Server, nil).RegisterEOFHook(func(err error) { eof <- err })
+	if err := p.Serve(rpc2.Protocol{
+		Name: "test.1.echo",
+		Methods: map[string]rpc2.ServeHook{
+			"echo": func(nxt rpc2.DecodeNext) (interface{}, error) {
+				var i int
+				err := nxt(&i)
+				return i, err
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var res int
+	if err := rpc2.NewClient(p.Client, nil).Call("test.1.echo.echo", 7, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res != 7 {
+		t.Fatalf("Bad result: %d != 7", res)
+	}
+
+	p.Close()
+	for _, xp := range []*rpc2.Transport{p.Client, p.Server} {
+		select {
+		case <-xp.Done():
+		default:
+			t.Fatal("Close returned before the transport was torn down")
+		}
+	}
+	select {
+	case <-eof:
+	default:
+		t.Fatal("Close returned before the EOF hook ran")
+	}
+}